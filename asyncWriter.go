@@ -0,0 +1,119 @@
+package logx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// asyncWriteTimeout is how long a write waits for room with QueueTimeout.
+const asyncWriteTimeout = 100 * time.Millisecond
+
+var ErrWriterClosed = errors.New("writer is closed")
+
+// AsyncWriter writes to another writer from a background goroutine, so that
+// the writes return without waiting for the disk or the network.
+type AsyncWriter struct {
+	w       io.Writer
+	queue   chan []byte
+	policy  QueueFullPolicy
+	dropped atomic.Int64
+	mu      sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewAsyncWriter returns an AsyncWriter buffering up to size writes to w.
+// When the buffer is full, a write is handled according to policy, waiting
+// up to 100ms with QueueTimeout. The dropped writes return ErrSinkFull, and
+// the errors of w are written to os.Stderr.
+func NewAsyncWriter(w io.Writer, size int, policy QueueFullPolicy) *AsyncWriter {
+	a := &AsyncWriter{
+		w:       w,
+		queue:   make(chan []byte, max(size, 1)),
+		policy:  policy,
+		dropped: atomic.Int64{},
+		mu:      sync.RWMutex{},
+		closed:  false,
+		wg:      sync.WaitGroup{},
+	}
+	a.wg.Add(1)
+	go a.run()
+
+	return a
+}
+
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		return 0, ErrWriterClosed
+	}
+	entry := append([]byte(nil), p...)
+	select {
+	case a.queue <- entry:
+		return len(p), nil
+	default:
+	}
+
+	switch a.policy {
+	case QueueBlock:
+		a.queue <- entry
+		return len(p), nil
+	case QueueDropOldest:
+		for {
+			select {
+			case a.queue <- entry:
+				return len(p), nil
+			case <-a.queue:
+				a.dropped.Add(1)
+			}
+		}
+	case QueueTimeout:
+		timer := time.NewTimer(asyncWriteTimeout)
+		defer timer.Stop()
+		select {
+		case a.queue <- entry:
+			return len(p), nil
+		case <-timer.C:
+		}
+	case QueueDropNewest:
+	}
+	a.dropped.Add(1)
+
+	return 0, ErrSinkFull
+}
+
+// Dropped returns the number of writes dropped because the buffer was full.
+func (a *AsyncWriter) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Close waits for the buffered writes to be written. The later writes fail
+// with ErrWriterClosed.
+func (a *AsyncWriter) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+
+	return nil
+}
+
+func (a *AsyncWriter) run() {
+	defer a.wg.Done()
+
+	for entry := range a.queue {
+		if _, err := a.w.Write(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "[AsyncWriter] %v\n", err)
+		}
+	}
+}
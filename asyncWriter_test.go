@@ -0,0 +1,55 @@
+package logx_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/alex-cos/logx"
+)
+
+// stalledWriter blocks its first write until released.
+type stalledWriter struct {
+	started chan struct{}
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	if w.started != nil {
+		close(w.started)
+		w.started = nil
+		<-w.release
+	}
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriter(t *testing.T) {
+	t.Parallel()
+
+	w := &stalledWriter{started: make(chan struct{}), release: make(chan struct{}), buf: bytes.Buffer{}}
+	started := w.started
+	async := logx.NewAsyncWriter(w, 1, logx.QueueDropNewest)
+
+	if _, err := async.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if _, err := async.Write([]byte("second\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := async.Write([]byte("third\n")); !errors.Is(err, logx.ErrSinkFull) {
+		t.Fatalf("expected a full buffer, got %v", err)
+	}
+	close(w.release)
+	if err := async.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := w.buf.String(); got != "first\nsecond\n" || async.Dropped() != 1 {
+		t.Fatalf("unexpected output %q, %d dropped", got, async.Dropped())
+	}
+	if _, err := async.Write([]byte("late\n")); !errors.Is(err, logx.ErrWriterClosed) {
+		t.Fatalf("expected a closed writer, got %v", err)
+	}
+}
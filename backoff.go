@@ -0,0 +1,67 @@
+package logx
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Backoff decides whether and when a failed push is retried.
+type Backoff interface {
+	// NextDelay is called after the failed attempt number attempt, starting
+	// at 0, with the server response if any. It returns the delay before the
+	// next attempt, or false to give up.
+	NextDelay(attempt int, resp *http.Response, err error) (time.Duration, bool)
+}
+
+// LinearBackoff waits (attempt+1)*Step plus a random jitter up to Jitter
+// between attempts, and gives up after Attempts attempts.
+type LinearBackoff struct {
+	Attempts int
+	Step     time.Duration
+	Jitter   time.Duration
+}
+
+// DefaultBackoff is the backoff used when none is set with WithBackoff.
+var DefaultBackoff = LinearBackoff{
+	Attempts: 3,
+	Step:     time.Second,
+	Jitter:   400 * time.Millisecond,
+}
+
+func (b LinearBackoff) NextDelay(attempt int, _ *http.Response, _ error) (time.Duration, bool) {
+	if attempt+1 >= b.Attempts {
+		return 0, false
+	}
+	delay := b.Step * time.Duration(attempt+1)
+	if b.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(b.Jitter))) // nolint: gosec
+	}
+
+	return delay, true
+}
+
+// ExponentialBackoff waits Base, doubled at each attempt up to Max, plus a
+// random jitter up to Jitter between attempts, and gives up after Retries
+// retries.
+type ExponentialBackoff struct {
+	Retries int
+	Base    time.Duration
+	Max     time.Duration
+	Jitter  time.Duration
+}
+
+func (b ExponentialBackoff) NextDelay(attempt int, _ *http.Response, _ error) (time.Duration, bool) {
+	if attempt >= b.Retries {
+		return 0, false
+	}
+	delay := b.Max
+	if attempt < 32 && b.Base<<attempt < b.Max {
+		delay = b.Base << attempt
+	}
+	if b.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(b.Jitter))) // nolint: gosec
+	}
+
+	return delay, true
+}
@@ -0,0 +1,38 @@
+package logx
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCircuitOpen is the error of the pushes skipped while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops the pushes for a cooldown after consecutive failures,
+// then lets a single push test whether Loki has recovered. It is only used
+// by the run loop, hence not synchronized.
+type circuitBreaker struct {
+	failures    int
+	cooldown    time.Duration
+	consecutive int
+	openedAt    time.Time
+}
+
+// allow reports whether a push may be made.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	return b.consecutive < b.failures || now.Sub(b.openedAt) >= b.cooldown
+}
+
+// record counts the outcome of a push, opening the circuit after too many
+// consecutive failures, or after the failure of the half-open test.
+func (b *circuitBreaker) record(now time.Time, err error) {
+	if err == nil {
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+	if b.consecutive >= b.failures {
+		b.openedAt = now
+	}
+}
@@ -0,0 +1,107 @@
+package logx
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// ColorMode tells whether the level of text records is colorized.
+type ColorMode int
+
+const (
+	// ColorNever never colorizes the output.
+	ColorNever ColorMode = iota
+	// ColorAuto colorizes terminal outputs unless NO_COLOR is set.
+	ColorAuto
+	// ColorAlways always colorizes the output.
+	ColorAlways
+)
+
+const colorReset = "\x1b[0m"
+
+var levelColors = map[string]string{
+	"trace": "\x1b[90m",
+	"debug": "\x1b[36m",
+	"info":  "\x1b[32m",
+	"warn":  "\x1b[33m",
+	"error": "\x1b[31m",
+	"fatal": "\x1b[35m",
+}
+
+// WithColor colorizes the level of text records when writing to a terminal
+// and NO_COLOR is not set, i.e. WithColorMode(ColorAuto), or never.
+func WithColor(b bool) LoggerOption {
+	if b {
+		return WithColorMode(ColorAuto)
+	}
+
+	return WithColorMode(ColorNever)
+}
+
+func WithColorMode(mode ColorMode) LoggerOption {
+	return func(c *loggerConfig) {
+		c.colorMode = mode
+	}
+}
+
+// colorWriter wraps the level token of each text record with ANSI colors.
+type colorWriter struct {
+	w io.Writer
+}
+
+func (cw colorWriter) Write(p []byte) (int, error) {
+	start := bytes.Index(p, []byte(" level="))
+	if start < 0 {
+		return cw.w.Write(p)
+	}
+	start += len(" level=")
+	end := bytes.IndexAny(p[start:], " \n")
+	if end < 0 {
+		end = len(p) - start
+	}
+	end += start
+	color, ok := levelColors[string(p[start:end])]
+	if !ok {
+		return cw.w.Write(p)
+	}
+
+	out := make([]byte, 0, len(p)+len(color)+len(colorReset))
+	out = append(out, p[:start]...)
+	out = append(out, color...)
+	out = append(out, p[start:end]...)
+	out = append(out, colorReset...)
+	out = append(out, p[end:]...)
+	if _, err := cw.w.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func colorize(w io.Writer, mode ColorMode) io.Writer {
+	switch mode {
+	case ColorAlways:
+		return colorWriter{w: w}
+	case ColorAuto:
+		if _, ok := os.LookupEnv("NO_COLOR"); !ok && isTerminal(w) {
+			return colorWriter{w: w}
+		}
+	case ColorNever:
+	}
+
+	return w
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
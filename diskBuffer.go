@@ -0,0 +1,181 @@
+package logx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	diskBufferFile = "loki-buffer.jsonl"
+	diskDrainFile  = "loki-buffer.draining.jsonl"
+)
+
+var errDiskBufferFull = errors.New("disk buffer is full")
+
+// diskBuffer spills entries to an append-only file, and hands them back for
+// sending. The entries being sent are moved to a second file, removed once
+// they are all delivered, so that nothing is lost if the process stops.
+type diskBuffer struct {
+	dir      string
+	maxBytes int64
+	mu       sync.Mutex
+	size     int64
+}
+
+// diskEntry is the JSON line of a spilled entry, with the idempotency key of
+// the batch it failed to be sent in, if any.
+type diskEntry struct {
+	Stream map[string]string `json:"stream,omitempty"`
+	Value  []any             `json:"value"`
+	Key    string            `json:"key,omitempty"`
+}
+
+func newDiskBuffer(dir string, maxBytes int64) (*diskBuffer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &diskBuffer{
+		dir:      dir,
+		maxBytes: maxBytes,
+		mu:       sync.Mutex{},
+		size:     0,
+	}
+	info, err := os.Stat(d.path(diskBufferFile))
+	switch {
+	case err == nil:
+		d.size = info.Size()
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *diskBuffer) path(name string) string {
+	return filepath.Join(d.dir, name)
+}
+
+// append writes entries at the end of the buffer file, with the idempotency
+// key of their batch if any, unless they would bring it over the max size.
+func (d *diskBuffer) append(entries []lokiEntry, key string) error {
+	spilled := make([]diskEntry, 0, len(entries))
+	for _, e := range entries {
+		spilled = append(spilled, diskEntry{Stream: e.stream, Value: e.value, Key: key})
+	}
+	buf, err := encodeDiskEntries(spilled)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.maxBytes > 0 && d.size+int64(len(buf)) > d.maxBytes {
+		return errDiskBufferFull
+	}
+	file, err := os.OpenFile(d.path(diskBufferFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, err := file.Write(buf)
+	d.size += int64(n)
+
+	return err
+}
+
+// take returns the entries to send: those left from a previous drain if any,
+// otherwise those of the buffer file, which is moved aside.
+func (d *diskBuffer) take() ([]diskEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	drain := d.path(diskDrainFile)
+	if _, err := os.Stat(drain); errors.Is(err, fs.ErrNotExist) {
+		if d.size == 0 {
+			return nil, nil
+		}
+		if err := os.Rename(d.path(diskBufferFile), drain); err != nil {
+			return nil, err
+		}
+		d.size = 0
+	}
+	file, err := os.Open(drain)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []diskEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var e diskEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || len(e.Value) < 2 {
+			// Skip a line partly written before a crash.
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// done records the outcome of a drain: the entries not delivered are kept
+// for the next one.
+func (d *diskBuffer) done(remaining []diskEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	drain := d.path(diskDrainFile)
+	if len(remaining) == 0 {
+		return os.Remove(drain)
+	}
+	buf, err := encodeDiskEntries(remaining)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(drain, buf, 0o644)
+}
+
+func encodeDiskEntries(entries []diskEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// diskBatch returns the number of leading entries to send as one batch: the
+// whole batch they were spilled from when it had an idempotency key, so that
+// the key still matches, up to batchSize entries otherwise.
+func diskBatch(entries []diskEntry, batchSize int) int {
+	key := entries[0].Key
+	n := 1
+	for n < len(entries) && entries[n].Key == key && (key != "" || n < batchSize) {
+		n++
+	}
+
+	return n
+}
+
+// lokiEntries turns spilled entries back into entries.
+func lokiEntries(entries []diskEntry) []lokiEntry {
+	converted := make([]lokiEntry, 0, len(entries))
+	for _, e := range entries {
+		converted = append(converted, lokiEntry{stream: e.Stream, value: e.Value, raw: nil})
+	}
+
+	return converted
+}
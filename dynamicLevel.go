@@ -2,15 +2,46 @@ package logx
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 )
 
 // DynamicLevel allows changing slog level at runtime.
 
 type DynamicLevel struct {
-	level atomic.Int32
+	level     atomic.Int32
+	initial   slog.Level
+	onChange  atomic.Pointer[func(oldLevel, newLevel slog.Level)]
+	mu        sync.Mutex
+	pending   []levelChange
+	notifying bool
+}
+
+// levelChange is a change waiting to be notified.
+type levelChange struct {
+	fn       func(oldLevel, newLevel slog.Level)
+	old, new slog.Level
+}
+
+// NewDynamicLevel returns a DynamicLevel set to l, which Reset restores.
+func NewDynamicLevel(l slog.Level) *DynamicLevel {
+	d := &DynamicLevel{
+		level:     atomic.Int32{},
+		initial:   l,
+		onChange:  atomic.Pointer[func(oldLevel, newLevel slog.Level)]{},
+		mu:        sync.Mutex{},
+		pending:   nil,
+		notifying: false,
+	}
+	d.SetLevel(l)
+
+	return d
 }
 
 func (d *DynamicLevel) Enabled(_ context.Context, l slog.Level) bool {
@@ -18,22 +49,126 @@ func (d *DynamicLevel) Enabled(_ context.Context, l slog.Level) bool {
 }
 
 func (d *DynamicLevel) SetLevel(l slog.Level) {
-	d.level.Store(int32(l)) // nolint: gosec
+	d.mu.Lock()
+	old := slog.Level(d.level.Swap(int32(l))) // nolint: gosec
+	fn := d.onChange.Load()
+	if old == l || fn == nil {
+		d.mu.Unlock()
+		return
+	}
+	d.pending = append(d.pending, levelChange{fn: *fn, old: old, new: l})
+	// The changes made while a callback runs, by the callback itself or
+	// concurrently, are notified by the call running it once it returns.
+	if d.notifying {
+		d.mu.Unlock()
+		return
+	}
+	d.notifying = true
+	for len(d.pending) > 0 {
+		change := d.pending[0]
+		d.pending = d.pending[1:]
+		d.mu.Unlock()
+		change.fn(change.old, change.new)
+		d.mu.Lock()
+	}
+	d.pending = nil
+	d.notifying = false
+	d.mu.Unlock()
+}
+
+// OnChange sets a function called by SetLevel with the previous and the new
+// level when the level changes, e.g. to log it. The calls are serialized, in
+// the order of the changes; a change made while the function runs, by itself
+// or concurrently, is notified once it returns.
+func (d *DynamicLevel) OnChange(fn func(oldLevel, newLevel slog.Level)) {
+	if fn == nil {
+		d.onChange.Store(nil)
+		return
+	}
+	d.onChange.Store(&fn)
+}
+
+// SetLevelString sets the level from its name, see ParseLevelStrict, leaving
+// it unchanged for an unknown name.
+func (d *DynamicLevel) SetLevelString(s string) error {
+	level, err := ParseLevelStrict(s)
+	if err != nil {
+		return err
+	}
+	d.SetLevel(level)
+
+	return nil
+}
+
+func (d *DynamicLevel) Reset() {
+	d.SetLevel(d.initial)
 }
 
 func (d *DynamicLevel) Level() slog.Level {
 	return slog.Level(d.level.Load())
 }
 
+// LevelString returns the current level as rendered in the logs, e.g. "info".
+func (d *DynamicLevel) LevelString() string {
+	return levelName(d.Level())
+}
+
+// ServeHTTP exposes the level: GET returns it as {"level":"info"}, PUT and
+// POST set it from the same JSON body, answering 400 for an unknown level.
+func (d *DynamicLevel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := d.SetLevelString(body.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": d.LevelString()}) // nolint: errcheck
+}
+
+// ParseLogLevel parses a level name like ParseLevelStrict, unknown names
+// being parsed as Info. Note that New parses them as Debug instead.
 func ParseLogLevel(s string) slog.Level {
-	switch strings.ToLower(s) {
+	level, err := ParseLevelStrict(s)
+	if err != nil {
+		return slog.LevelInfo
+	}
+
+	return level
+}
+
+// ParseLevelStrict parses a level name, trace, debug, info, warn (or
+// warning), error or fatal, in any case, and returns an error for any other
+// name.
+func ParseLevelStrict(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace":
+		return LevelTrace, nil
 	case "debug":
-		return slog.LevelDebug
-	case "warn":
-		return slog.LevelWarn
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
 	case "error":
-		return slog.LevelError
+		return slog.LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
 	default:
-		return slog.LevelInfo
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", s)
 	}
 }
@@ -0,0 +1,181 @@
+package logx_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alex-cos/logx"
+)
+
+func TestDynamicLevelReset(t *testing.T) {
+	t.Parallel()
+
+	level := logx.NewDynamicLevel(slog.LevelWarn)
+	level.SetLevel(slog.LevelDebug)
+	if level.Level() != slog.LevelDebug {
+		t.Fatalf("unexpected level %s", level.Level())
+	}
+
+	level.Reset()
+	if level.Level() != slog.LevelWarn {
+		t.Fatalf("expected Reset to restore warn, got %s", level.Level())
+	}
+}
+
+func TestDynamicLevelString(t *testing.T) {
+	t.Parallel()
+
+	level := logx.NewDynamicLevel(slog.LevelInfo)
+	if level.LevelString() != "info" {
+		t.Fatalf("unexpected level %q", level.LevelString())
+	}
+
+	level.SetLevel(slog.LevelError)
+	if level.LevelString() != "error" {
+		t.Fatalf("unexpected level %q", level.LevelString())
+	}
+}
+
+func TestParseLevelStrict(t *testing.T) {
+	t.Parallel()
+
+	level, err := logx.ParseLevelStrict(" Warning ")
+	if err != nil || level != slog.LevelWarn {
+		t.Fatalf("unexpected level %s (%v)", level, err)
+	}
+	if _, err := logx.ParseLevelStrict("inf"); err == nil {
+		t.Fatal("expected an unknown level to be rejected")
+	}
+	if level := logx.ParseLogLevel("inf"); level != slog.LevelInfo {
+		t.Fatalf("expected ParseLogLevel to default to info, got %s", level)
+	}
+}
+
+func TestDynamicLevelHTTP(t *testing.T) {
+	t.Parallel()
+
+	level := logx.NewDynamicLevel(slog.LevelInfo)
+	srv := httptest.NewServer(level)
+	defer srv.Close()
+	do := func(method, body string) (int, string) {
+		req, err := http.NewRequestWithContext(context.Background(), method, srv.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	if code, body := do(http.MethodGet, ""); code != http.StatusOK || body != `{"level":"info"}` {
+		t.Fatalf("unexpected response %d %s", code, body)
+	}
+	if code, body := do(http.MethodPut, `{"level":"debug"}`); code != http.StatusOK || body != `{"level":"debug"}` {
+		t.Fatalf("unexpected response %d %s", code, body)
+	}
+	if code, _ := do(http.MethodPost, `{"level":"verbose"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown level to be rejected, got %d", code)
+	}
+	if level.Level() != slog.LevelDebug {
+		t.Fatalf("unexpected level %s", level.Level())
+	}
+}
+
+func TestDynamicLevelLogger(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	level := logx.NewDynamicLevel(slog.LevelInfo)
+	logger := logx.NewWithLeveler([]io.Writer{&buf}, level, false, true)
+	logger.Debug("hidden")
+	level.SetLevel(slog.LevelDebug)
+	logger.Debug("shown")
+
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "shown") {
+		t.Fatalf("level changes not honored: %q", out)
+	}
+}
+
+func TestDynamicLevelSetLevelString(t *testing.T) {
+	t.Parallel()
+
+	level := logx.NewDynamicLevel(slog.LevelInfo)
+	if err := level.SetLevelString("WARN"); err != nil || level.Level() != slog.LevelWarn {
+		t.Fatalf("unexpected level %s (%v)", level.Level(), err)
+	}
+	if err := level.SetLevelString("verbose"); err == nil {
+		t.Fatal("expected an unknown level to be rejected")
+	}
+	if level.Level() != slog.LevelWarn {
+		t.Fatalf("expected the level to be unchanged, got %s", level.Level())
+	}
+}
+
+func TestDynamicLevelOnChange(t *testing.T) {
+	t.Parallel()
+
+	level := logx.NewDynamicLevel(slog.LevelInfo)
+	var changes []string
+	depth, maxDepth := 0, 0
+	level.OnChange(func(oldLevel, newLevel slog.Level) {
+		depth++
+		maxDepth = max(maxDepth, depth)
+		changes = append(changes, oldLevel.String()+">"+newLevel.String())
+		// A change made by the callback is notified once it returns.
+		level.SetLevel(slog.LevelError)
+		depth--
+	})
+	level.SetLevel(slog.LevelInfo)
+	level.SetLevel(slog.LevelDebug)
+
+	if strings.Join(changes, ",") != "INFO>DEBUG,DEBUG>ERROR" || maxDepth != 1 {
+		t.Fatalf("unexpected changes: %v (depth %d)", changes, maxDepth)
+	}
+	if level.Level() != slog.LevelError {
+		t.Fatalf("unexpected level %s", level.Level())
+	}
+}
+
+func TestDynamicLevelOnChangeConcurrent(t *testing.T) {
+	t.Parallel()
+
+	level := logx.NewDynamicLevel(slog.LevelInfo)
+	var changes [][2]slog.Level
+	level.OnChange(func(oldLevel, newLevel slog.Level) {
+		changes = append(changes, [2]slog.Level{oldLevel, newLevel})
+	})
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 200 {
+				level.SetLevel(slog.Level((i + j) % 3 * 4))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every change is notified, in order: each starts from the previous one.
+	current := slog.LevelInfo
+	for _, c := range changes {
+		if c[0] != current || c[0] == c[1] {
+			t.Fatalf("unexpected change %v after %v", c, current)
+		}
+		current = c[1]
+	}
+	if current != level.Level() {
+		t.Fatalf("last notified level %v, level %v", current, level.Level())
+	}
+}
@@ -0,0 +1,21 @@
+package logx
+
+import (
+	"os"
+	"time"
+)
+
+func RotationName(basename, ext string, creationTime, now time.Time, utc bool) string {
+	return rotationName(basename, ext, creationTime, now, utc, 0)
+}
+
+var RotationNameInterval = rotationName
+
+// SetExit replaces os.Exit in Fatal, returning a function restoring it.
+func SetExit(fn func(code int)) func() {
+	exit = fn
+
+	return func() {
+		exit = os.Exit
+	}
+}
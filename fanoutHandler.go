@@ -0,0 +1,71 @@
+package logx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+// NewLevelRouted returns a logger writing the records of each minimum level
+// of routes, and above, to its writers, e.g. everything from info to the
+// main log and errors to an errors.log too. The options apply to every
+// route, but for the level.
+func NewLevelRouted(routes map[slog.Level][]io.Writer, opts ...LoggerOption) *slog.Logger {
+	handlers := make([]slog.Handler, 0, len(routes))
+	for _, level := range slices.Sorted(maps.Keys(routes)) {
+		routeOpts := append(slices.Clone(opts), WithLeveler(level))
+		handlers = append(handlers, NewWithOptions(routes[level], routeOpts...).Handler())
+	}
+
+	return slog.New(NewFanoutHandler(handlers...))
+}
+
+// NewFanoutHandler returns a handler passing each record to all the handlers
+// enabled for its level.
+func NewFanoutHandler(handlers ...slog.Handler) slog.Handler {
+	return fanoutHandler(handlers)
+}
+
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+
+	return handlers
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+
+	return handlers
+}
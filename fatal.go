@@ -0,0 +1,49 @@
+package logx
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	exitMu    sync.Mutex
+	exitFuncs []func()
+	exit      = os.Exit
+)
+
+// AtExit registers fn to be run by Fatal before exiting, e.g. the Close of a
+// Loki client or of a rotated file, so that their buffered logs are written.
+// The functions run in the reverse order of their registration.
+func AtExit(fn func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+
+	exitFuncs = append(exitFuncs, fn)
+}
+
+// Fatal logs msg at the LevelFatal level with logger, reporting the caller as the
+// source, runs the functions registered with AtExit, and exits the process
+// with status 1. Deferred functions are not run.
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	ctx := context.Background()
+	if logger.Enabled(ctx, LevelFatal) {
+		var pcs [1]uintptr
+		runtime.Callers(2, pcs[:]) // skip Callers and Fatal
+		r := slog.NewRecord(time.Now(), LevelFatal, msg, pcs[0])
+		r.Add(args...)
+		_ = logger.Handler().Handle(ctx, r)
+	}
+
+	exitMu.Lock()
+	funcs := slices.Clone(exitFuncs)
+	exitMu.Unlock()
+	for _, fn := range slices.Backward(funcs) {
+		fn()
+	}
+	exit(1)
+}
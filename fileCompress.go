@@ -0,0 +1,82 @@
+package logx
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// WithCompress gzips the files once rotated, in the background, replacing
+// them with a .gz file.
+func WithCompress(b bool) FileOption {
+	return func(c *fileConfig) {
+		c.compress = b
+	}
+}
+
+// compressFile replaces the file at path by its gzip compressed .gz copy. On
+// failure, the file is left as it is.
+func compressFile(path string, mode os.FileMode) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp) // nolint: errcheck
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// compressions tracks the files being compressed in the background, which
+// pruning must not remove from under the compression.
+type compressions struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+	wg    sync.WaitGroup
+}
+
+func (c *compressions) start(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths[path] = struct{}{}
+	c.wg.Add(1)
+}
+
+func (c *compressions) done(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.paths, path)
+	c.wg.Done()
+}
+
+// busy reports whether path, or the file path is the .gz copy of, is being
+// compressed.
+func (c *compressions) busy(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.paths[strings.TrimSuffix(path, ".gz")]
+
+	return ok
+}
@@ -0,0 +1,89 @@
+package logx
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// WithMaxAge removes, at each rotation, the rotated files of more than days
+// days ago.
+func WithMaxAge(days int) FileOption {
+	return func(c *fileConfig) {
+		c.maxAge = days
+	}
+}
+
+// WithMaxFiles keeps, at each rotation, only the n most recent files,
+// including the current one.
+func WithMaxFiles(n int) FileOption {
+	return func(c *fileConfig) {
+		c.maxFiles = n
+	}
+}
+
+// rotatedFile is a file named by the rotation scheme.
+type rotatedFile struct {
+	path  string
+	start time.Time
+	seq   int
+}
+
+// rotatedFiles lists the files of dir named by the rotation scheme of
+// basename and ext, most recent first.
+func rotatedFiles(dir, basename, ext string) []rotatedFile {
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(basename) + `_(\d{4}-\d{2}-\d{2}(?:_\d{2}(?:-\d{2})?)?)(?:\.(\d+))?` + regexp.QuoteMeta(ext) + `(?:\.gz)?$`)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files []rotatedFile
+	for _, e := range entries {
+		m := pattern.FindStringSubmatch(e.Name())
+		if m == nil || !e.Type().IsRegular() {
+			continue
+		}
+		layout := FileDateTimeFormat
+		switch len(m[1]) {
+		case len(FileDateTimeFormat) + 3:
+			layout += "_15"
+		case len(FileDateTimeFormat) + 6:
+			layout += "_15-04"
+		}
+		start, err := time.Parse(layout, m[1])
+		if err != nil {
+			continue
+		}
+		seq, _ := strconv.Atoi(m[2])
+		files = append(files, rotatedFile{path: filepath.Join(dir, e.Name()), start: start, seq: seq})
+	}
+	slices.SortFunc(files, func(a, b rotatedFile) int {
+		return cmp.Or(b.start.Compare(a.start), cmp.Compare(b.seq, a.seq))
+	})
+
+	return files
+}
+
+// pruneFiles removes the rotated files beyond the retention, but current and
+// those busy, being compressed.
+func pruneFiles(dir, basename, ext, current string, now time.Time, cfg fileConfig, busy func(path string) bool) {
+	if cfg.maxAge <= 0 && cfg.maxFiles <= 0 {
+		return
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for i, f := range rotatedFiles(dir, basename, ext) {
+		if f.path == current || busy(f.path) {
+			continue
+		}
+		day := time.Date(f.start.Year(), f.start.Month(), f.start.Day(), 0, 0, 0, 0, time.UTC)
+		tooOld := cfg.maxAge > 0 && today.Sub(day) > time.Duration(cfg.maxAge)*24*time.Hour
+		tooMany := cfg.maxFiles > 0 && i >= cfg.maxFiles
+		if tooOld || tooMany {
+			os.Remove(f.path) // nolint: errcheck
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package logx
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+)
+
+// WithFilter drops the records failing predicate, see NewFiltered.
+func WithFilter(predicate func(ctx context.Context, r slog.Record) bool) LoggerOption {
+	return func(c *loggerConfig) {
+		c.filter = predicate
+	}
+}
+
+// NewFiltered wraps a handler to drop the records failing predicate before
+// they are formatted. The record given to predicate also has the attributes
+// added with With, whatever their group.
+func NewFiltered(inner slog.Handler, predicate func(ctx context.Context, r slog.Record) bool) slog.Handler {
+	return filterHandler{inner, predicate, nil}
+}
+
+type filterHandler struct {
+	slog.Handler
+	predicate func(ctx context.Context, r slog.Record) bool
+	attrs     []slog.Attr
+}
+
+func (h filterHandler) Handle(ctx context.Context, r slog.Record) error {
+	checked := r
+	if len(h.attrs) > 0 {
+		checked = r.Clone()
+		checked.AddAttrs(h.attrs...)
+	}
+	if !h.predicate(ctx, checked) {
+		return nil
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h filterHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return filterHandler{h.Handler.WithAttrs(attrs), h.predicate, append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h filterHandler) WithGroup(name string) slog.Handler {
+	return filterHandler{h.Handler.WithGroup(name), h.predicate, h.attrs}
+}
@@ -0,0 +1,50 @@
+package logx
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// SetDefault makes logger the default logger used by the package-level
+// logging functions, and by slog's ones.
+func SetDefault(logger *slog.Logger) {
+	slog.SetDefault(logger)
+}
+
+func Trace(msg string, args ...any) {
+	logDefault(LevelTrace, msg, args...)
+}
+
+func Debug(msg string, args ...any) {
+	logDefault(slog.LevelDebug, msg, args...)
+}
+
+func Info(msg string, args ...any) {
+	logDefault(slog.LevelInfo, msg, args...)
+}
+
+func Warn(msg string, args ...any) {
+	logDefault(slog.LevelWarn, msg, args...)
+}
+
+// ErrorMsg logs at the error level, Error building an error attribute.
+func ErrorMsg(msg string, args ...any) {
+	logDefault(slog.LevelError, msg, args...)
+}
+
+// logDefault logs with the default logger, reporting the caller of the
+// package-level function as the source.
+func logDefault(level slog.Level, msg string, args ...any) {
+	ctx := context.Background()
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:]) // skip Callers, logDefault and the logging function
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.Add(args...)
+	_ = logger.Handler().Handle(ctx, r)
+}
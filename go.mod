@@ -2,4 +2,9 @@ module github.com/alex-cos/logx
 
 go 1.23
 
-require github.com/kjk/common v0.0.0-20250727204022-045a9eb5e305
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/kjk/common v0.0.0-20250727204022-045a9eb5e305
+	go.opentelemetry.io/otel v1.35.0
+	go.opentelemetry.io/otel/trace v1.35.0
+)
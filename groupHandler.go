@@ -0,0 +1,60 @@
+package logx
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+)
+
+// groupHandler nests the record attributes under the group of WithGroup
+// before they reach the wrapped handlers, so that the attributes those add,
+// like the trace and stack ones, stay at the top level.
+type groupHandler struct {
+	slog.Handler
+	groups []groupFrame
+}
+
+// groupFrame is a group and the attributes added to it with WithAttrs.
+type groupFrame struct {
+	name  string
+	attrs []slog.Attr
+}
+
+func newGroupHandler(inner slog.Handler, name string) slog.Handler {
+	return groupHandler{inner, []groupFrame{{name: name, attrs: nil}}}
+}
+
+func (h groupHandler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	for i := len(h.groups) - 1; i >= 0; i-- {
+		g := h.groups[i]
+		attrs = []slog.Attr{{Key: g.name, Value: slog.GroupValue(append(slices.Clip(g.attrs), attrs...)...)}}
+	}
+	grouped := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	grouped.AddAttrs(attrs...)
+
+	return h.Handler.Handle(ctx, grouped)
+}
+
+func (h groupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	groups := slices.Clone(h.groups)
+	last := &groups[len(groups)-1]
+	last.attrs = append(slices.Clip(last.attrs), attrs...)
+
+	return groupHandler{h.Handler, groups}
+}
+
+func (h groupHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return groupHandler{h.Handler, append(slices.Clip(h.groups), groupFrame{name: name, attrs: nil})}
+}
@@ -1,12 +1,15 @@
 package logx
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kjk/common/filerotate"
@@ -18,27 +21,247 @@ const (
 	DateTimeFormatNano  = "2006-01-02T15:04:05.000000000Z07:00"
 	FileDateTimeFormat  = "2006-01-02"
 	SError              = "error"
+	STraceID            = "trace_id"
+	SSpanID             = "span_id"
+	SStackTrace         = "stacktrace"
+	SCaller             = "caller"
 )
 
-func New(writers []io.Writer, level string, json, utc bool) *slog.Logger {
-	slevel := parseLevel(level)
-	root := findModuleRoot()
+const (
+	// LevelTrace is below the debug level, rendered as "trace".
+	LevelTrace = slog.Level(-8)
+	// LevelFatal is above the error level, rendered as "fatal".
+	LevelFatal = slog.Level(12)
+)
+
+type loggerConfig struct {
+	level          string
+	leveler        slog.Leveler
+	json           bool
+	utc            bool
+	timeFormat     string
+	source         bool
+	callerKey      string
+	handlerOptions func(*slog.HandlerOptions)
+	colorMode      ColorMode
+	traceContext   bool
+	stackTrace     bool
+	stackLevel     slog.Level
+	redactKeys     []string
+	sampling       int
+	filter         func(ctx context.Context, r slog.Record) bool
+	errWriter      io.Writer
+	errLevel       slog.Level
+	group          string
+}
+
+type LoggerOption func(*loggerConfig)
+
+// WithLevel sets the minimum level, "Info" by default for NewWithOptions.
+func WithLevel(level string) LoggerOption {
+	return func(c *loggerConfig) {
+		c.level = level
+	}
+}
+
+// WithLeveler sets the leveler consulted for each record, e.g. a
+// DynamicLevel, instead of the WithLevel one.
+func WithLeveler(leveler slog.Leveler) LoggerOption {
+	return func(c *loggerConfig) {
+		c.leveler = leveler
+	}
+}
+
+// WithErrorWriter also writes the records of level and above to w, e.g.
+// os.Stderr for the warnings and errors to be captured apart from stdout.
+// The records below the logger level are written to neither.
+func WithErrorWriter(w io.Writer, level slog.Level) LoggerOption {
+	return func(c *loggerConfig) {
+		c.errWriter = w
+		c.errLevel = level
+	}
+}
+
+// WithGroup nests the attributes of the records under the named group, e.g.
+// "http" or "db". The trace and stack attributes stay at the top level.
+func WithGroup(name string) LoggerOption {
+	return func(c *loggerConfig) {
+		c.group = name
+	}
+}
+
+// WithJSON selects the JSON format instead of the text one.
+func WithJSON(b bool) LoggerOption {
+	return func(c *loggerConfig) {
+		c.json = b
+	}
+}
+
+// WithUTC writes the record times in UTC instead of the local time.
+func WithUTC(b bool) LoggerOption {
+	return func(c *loggerConfig) {
+		c.utc = b
+	}
+}
+
+// WithTimeFormat sets the layout of the record times, DateTimeFormatMilli by
+// default, e.g. DateTimeFormatMicro or time.RFC3339Nano. A LokiClient parses
+// the RFC 3339 layouts only, unless given the layout with WithTimeLayout.
+func WithTimeFormat(layout string) LoggerOption {
+	return func(c *loggerConfig) {
+		if layout != "" {
+			c.timeFormat = layout
+		}
+	}
+}
+
+// WithCallerKey sets the key of the caller of the records, SCaller by
+// default, e.g. "source" or "file".
+func WithCallerKey(key string) LoggerOption {
+	return func(c *loggerConfig) {
+		if key != "" {
+			c.callerKey = key
+		}
+	}
+}
+
+// WithSource toggles the caller of the records, on by default.
+func WithSource(b bool) LoggerOption {
+	return func(c *loggerConfig) {
+		c.source = b
+	}
+}
+
+// WithHandlerOptions lets the caller adjust the slog.HandlerOptions once logx
+// has set its defaults and before the handler is built.
+func WithHandlerOptions(fn func(*slog.HandlerOptions)) LoggerOption {
+	return func(c *loggerConfig) {
+		c.handlerOptions = fn
+	}
+}
+
+func New(writers []io.Writer, level string, json, utc bool, opts ...LoggerOption) *slog.Logger {
+	positional := []LoggerOption{WithLevel(level), WithJSON(json), WithUTC(utc)}
+
+	return NewWithOptions(writers, append(positional, opts...)...)
+}
+
+// NewWithLeveler is New with a leveler consulted for each record, e.g. a
+// DynamicLevel, instead of a fixed level.
+func NewWithLeveler(writers []io.Writer, leveler slog.Leveler, json, utc bool, opts ...LoggerOption) *slog.Logger {
+	positional := []LoggerOption{WithLeveler(leveler), WithJSON(json), WithUTC(utc)}
+
+	return NewWithOptions(writers, append(positional, opts...)...)
+}
+
+// NewWithOptions is New configured by options only. It defaults to text
+// records at the info level, with local times and the caller.
+func NewWithOptions(writers []io.Writer, opts ...LoggerOption) *slog.Logger {
+	cfg := loggerConfig{
+		level:          "Info",
+		leveler:        nil,
+		json:           false,
+		utc:            false,
+		timeFormat:     DateTimeFormatMilli,
+		source:         true,
+		callerKey:      SCaller,
+		handlerOptions: nil,
+		colorMode:      ColorNever,
+		traceContext:   false,
+		stackTrace:     false,
+		stackLevel:     slog.LevelError,
+		redactKeys:     nil,
+		sampling:       0,
+		filter:         nil,
+		errWriter:      nil,
+		errLevel:       slog.LevelWarn,
+		group:          "",
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	handler := newHandler(writers, cfg)
+	if cfg.errWriter != nil {
+		errCfg := cfg
+		errCfg.leveler = maxLeveler{cfg.levelerOrDefault(), cfg.errLevel}
+		handler = NewFanoutHandler(handler, newHandler([]io.Writer{cfg.errWriter}, errCfg))
+	}
+
+	return slog.New(handler)
+}
+
+// levelerOrDefault returns the leveler of WithLeveler, or the level of
+// WithLevel.
+func (cfg loggerConfig) levelerOrDefault() slog.Leveler {
+	if cfg.leveler != nil {
+		return cfg.leveler
+	}
+
+	return parseLevel(cfg.level)
+}
+
+// maxLeveler is the highest of two levels, consulted for each record.
+type maxLeveler struct {
+	a, b slog.Leveler
+}
+
+func (l maxLeveler) Level() slog.Level {
+	return max(l.a.Level(), l.b.Level())
+}
+
+// newHandler builds the handler of a logger writing to writers.
+func newHandler(writers []io.Writer, cfg loggerConfig) slog.Handler {
+	slevel := cfg.levelerOrDefault()
+	// The module root is only needed to shorten the caller paths.
+	root := ""
+	if cfg.source {
+		root = findModuleRoot()
+	}
+	if !cfg.json && cfg.colorMode != ColorNever {
+		colored := make([]io.Writer, 0, len(writers))
+		for _, w := range writers {
+			colored = append(colored, colorize(w, cfg.colorMode))
+		}
+		writers = colored
+	}
 	w := io.MultiWriter(writers...)
 
 	handlerOptions := &slog.HandlerOptions{
-		AddSource:   true,
+		AddSource:   cfg.source,
 		Level:       slevel,
-		ReplaceAttr: computeReplaceAttr(root, utc),
+		ReplaceAttr: computeReplaceAttr(root, cfg.utc, cfg.timeFormat, cfg.callerKey),
+	}
+	if cfg.handlerOptions != nil {
+		cfg.handlerOptions(handlerOptions)
+	}
+	if len(cfg.redactKeys) > 0 {
+		handlerOptions.ReplaceAttr = redactAttr(cfg.redactKeys, handlerOptions.ReplaceAttr)
 	}
 
 	var handler slog.Handler
-	if json {
+	if cfg.json {
 		handler = slog.NewJSONHandler(w, handlerOptions)
 	} else {
 		handler = slog.NewTextHandler(w, handlerOptions)
 	}
+	if cfg.traceContext {
+		handler = NewTraceHandler(handler)
+	}
+	if cfg.stackTrace {
+		handler = NewStackTraceHandler(handler, cfg.stackLevel)
+	}
+	if cfg.group != "" {
+		handler = newGroupHandler(handler, cfg.group)
+	}
+	if cfg.sampling > 1 {
+		handler = NewSampled(handler, cfg.sampling)
+	}
+	if cfg.filter != nil {
+		handler = NewFiltered(handler, cfg.filter)
+	}
 
-	return slog.New(handler)
+	return handler
 }
 
 func NewFileLogger(
@@ -47,6 +270,7 @@ func NewFileLogger(
 	json bool,
 	utc bool,
 	verbose bool,
+	opts ...LoggerOption,
 ) (*slog.Logger, Close) {
 	w := []io.Writer{}
 
@@ -56,42 +280,163 @@ func NewFileLogger(
 		w = append(w, os.Stdout)
 	}
 
-	return New(w, level, json, utc), closeFile
+	return New(w, level, json, utc, opts...), closeFile
+}
+
+func NewConsoleLogger(level string, json, utc bool, opts ...LoggerOption) *slog.Logger {
+	return New([]io.Writer{os.Stdout}, level, json, utc, opts...)
+}
+
+type fileConfig struct {
+	dirMode  os.FileMode
+	fileMode os.FileMode
+	maxBytes int64
+	maxAge   int
+	maxFiles int
+	compress bool
+	interval time.Duration
+}
+
+type FileOption func(*fileConfig)
+
+// WithDirMode sets the permissions of the log directories created when
+// missing.
+func WithDirMode(mode os.FileMode) FileOption {
+	return func(c *fileConfig) {
+		c.dirMode = mode
+	}
 }
 
-func NewConsoleLogger(level string, json, utc bool) *slog.Logger {
-	return New([]io.Writer{os.Stdout}, level, json, utc)
+// WithFileMode sets the permissions of the created log files.
+func WithFileMode(mode os.FileMode) FileOption {
+	return func(c *fileConfig) {
+		c.fileMode = mode
+	}
 }
 
-func NewFileRotate(logpath string, utc bool) (io.Writer, Close) {
+func NewFileRotate(logpath string, utc bool, opts ...FileOption) (io.Writer, Close) {
+	cfg := fileConfig{
+		dirMode:  0o755,
+		fileMode: 0o644,
+		maxBytes: 0,
+		maxAge:   0,
+		maxFiles: 0,
+		compress: false,
+		interval: 0,
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
 	dir := filepath.Dir(logpath)
 	filename := filepath.Base(logpath)
 	ext := filepath.Ext(filename)
 	basename := strings.TrimSuffix(filename, ext)
+	counter := &countingWriter{w: nil, written: atomic.Int64{}}
+	seq := 0
+	compressing := &compressions{mu: sync.Mutex{}, paths: make(map[string]struct{}), wg: sync.WaitGroup{}}
+	current := ""
 	fileconfig := filerotate.Config{
 		DidClose: func(path string, didRotate bool) {
-			// By default do noting
+			if !didRotate || !cfg.compress {
+				return
+			}
+			compressing.start(path)
+			next := current
+			go func() {
+				err := compressFile(path, cfg.fileMode)
+				compressing.done(path)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "[logx] failed to compress %s: %v\n", path, err)
+					return
+				}
+				// The .gz file was skipped by the pruning of the rotation.
+				pruneFiles(dir, basename, ext, next, inZone(time.Now(), utc), cfg, compressing.busy)
+			}()
 		},
 		PathIfShouldRotate: func(creationTime time.Time, now time.Time) string {
-			if creationTime.YearDay() == now.YearDay() {
+			name := rotationName(basename, ext, creationTime, now, utc, cfg.interval)
+			switch {
+			case name != "":
+				seq = 0
+			case cfg.maxBytes > 0 && counter.written.Load() >= cfg.maxBytes:
+				seq++
+			default:
 				return ""
 			}
-			d := now
-			if utc {
-				d = now.UTC()
+			path := filepath.Join(dir, sizeRotationName(basename, ext, now, utc, cfg.interval, seq))
+			// Skip the files of the day already full, e.g. after a restart.
+			for cfg.maxBytes > 0 {
+				info, err := os.Stat(path)
+				full := err == nil && info.Size() >= cfg.maxBytes
+				if _, err := os.Stat(path + ".gz"); err == nil {
+					full = true
+				}
+				if !full {
+					break
+				}
+				seq++
+				path = filepath.Join(dir, sizeRotationName(basename, ext, now, utc, cfg.interval, seq))
+			}
+			createFile(path, cfg)
+			if info, err := os.Stat(path); err == nil {
+				counter.written.Store(info.Size())
 			}
-			name := fmt.Sprintf("%s_%s%s", basename, d.Format(FileDateTimeFormat), ext)
-			return filepath.Join(dir, name)
+			// The file being closed is pruned once compressed.
+			closing := current
+			current = path
+			pruneFiles(dir, basename, ext, path, inZone(now, utc), cfg, func(p string) bool {
+				return (cfg.compress && p == closing) || compressing.busy(p)
+			})
+			return path
 		},
 	}
 	file, err := filerotate.New(&fileconfig)
 	if err != nil {
 		panic(err)
 	}
-
-	return file, func() {
+	closeFile := func() {
 		file.Close()
+		compressing.wg.Wait()
 	}
+	if cfg.maxBytes <= 0 {
+		return file, closeFile
+	}
+	counter.w = file
+
+	return counter, closeFile
+}
+
+// NewFileRotateSize is NewFileRotate also rotating the file once it reaches
+// maxBytes, the files of a same day getting an incrementing suffix, e.g.
+// app_2025-01-02.1.log.
+func NewFileRotateSize(logpath string, utc bool, maxBytes int64, opts ...FileOption) (io.Writer, Close) {
+	return NewFileRotate(logpath, utc, append(opts, func(c *fileConfig) {
+		c.maxBytes = maxBytes
+	})...)
+}
+
+// NewFileRotateInterval is NewFileRotate rotating the file at every interval
+// instead of every day, e.g. hourly. The file names get the hour, or the
+// minute, of the interval start when it is shorter than a day, or an hour,
+// e.g. app_2025-01-02_15.log.
+func NewFileRotateInterval(logpath string, utc bool, interval time.Duration, opts ...FileOption) (io.Writer, Close) {
+	return NewFileRotate(logpath, utc, append(opts, func(c *fileConfig) {
+		c.interval = interval
+	})...)
+}
+
+// countingWriter counts the bytes written to the current rotated file.
+type countingWriter struct {
+	w       io.Writer
+	written atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.written.Add(int64(n))
+
+	return n, err
 }
 
 func Error(err error) slog.Attr {
@@ -105,34 +450,56 @@ func Error(err error) slog.Attr {
 // Unexported functions
 // ----------------------------------------------------------------------------
 
+// parseLevel parses a level name, unknown names being parsed as Debug so
+// that nothing is hidden by a typo.
 func parseLevel(s string) slog.Level {
-	switch strings.ToLower(strings.TrimSpace(s)) {
-	case "debug":
+	level, err := ParseLevelStrict(s)
+	if err != nil {
 		return slog.LevelDebug
-	case "info":
-		return slog.LevelInfo
-	case "warn", "warning":
-		return slog.LevelWarn
-	case "error":
-		return slog.LevelError
+	}
+
+	return level
+}
+
+// levelName renders a level the way logx outputs it, e.g. "info".
+func levelName(l slog.Level) string {
+	switch l {
+	case LevelTrace:
+		return "trace"
+	case LevelFatal:
+		return "fatal"
 	default:
-		return slog.LevelDebug
+		return strings.ToLower(l.String())
 	}
 }
 
-func computeReplaceAttr(root string, utc bool) func(groups []string, a slog.Attr) slog.Attr {
+func computeReplaceAttr(root string, utc bool, timeFormat, callerKey string) func(groups []string, a slog.Attr) slog.Attr {
 	return func(groups []string, a slog.Attr) slog.Attr {
+		// The builtin attributes are never in a group, unlike the user ones
+		// which may have the same keys.
+		if len(groups) > 0 {
+			return a
+		}
 		switch a.Key {
 		case slog.TimeKey:
+			if a.Value.Kind() != slog.KindTime {
+				return a
+			}
 			t := a.Value.Time()
 			if utc {
 				t = t.UTC()
 			}
 			return slog.Attr{
 				Key:   slog.TimeKey,
-				Value: slog.StringValue(t.Format(DateTimeFormatMilli)),
+				Value: slog.StringValue(t.Format(timeFormat)),
 			}
 		case slog.LevelKey:
+			if l, ok := a.Value.Any().(slog.Level); ok {
+				return slog.Attr{
+					Key:   slog.LevelKey,
+					Value: slog.StringValue(levelName(l)),
+				}
+			}
 			return slog.Attr{
 				Key:   slog.LevelKey,
 				Value: slog.StringValue(strings.ToLower(a.Value.String())),
@@ -149,7 +516,7 @@ func computeReplaceAttr(root string, utc bool) func(groups []string, a slog.Attr
 				}
 				file = filepath.ToSlash(file)
 				return slog.Attr{
-					Key:   "caller",
+					Key:   callerKey,
 					Value: slog.StringValue(fmt.Sprintf("%s:%d", file, v.Line)),
 				}
 			}
@@ -159,6 +526,83 @@ func computeReplaceAttr(root string, utc bool) func(groups []string, a slog.Attr
 	}
 }
 
+// rotationName returns the name of the file to rotate to when now is not in
+// the interval the current file was created in, or "" otherwise. Both the
+// comparison and the name use UTC times when utc is set, local times
+// otherwise.
+func rotationName(basename, ext string, creationTime, now time.Time, utc bool, interval time.Duration) string {
+	creationTime, now = inZone(creationTime, utc), inZone(now, utc)
+	if periodStart(creationTime, interval).Equal(periodStart(now, interval)) {
+		return ""
+	}
+
+	return sizeRotationName(basename, ext, now, utc, interval, 0)
+}
+
+// sizeRotationName returns the name of the seq-th file of the interval of
+// now, the first one having no suffix.
+func sizeRotationName(basename, ext string, now time.Time, utc bool, interval time.Duration, seq int) string {
+	start := periodStart(inZone(now, utc), interval).Format(periodLayout(interval))
+	if seq == 0 {
+		return fmt.Sprintf("%s_%s%s", basename, start, ext)
+	}
+
+	return fmt.Sprintf("%s_%s.%d%s", basename, start, seq, ext)
+}
+
+// periodStart returns the start of the rotation interval of t, a day when
+// interval is 0. Sub-daily intervals start at midnight, longer ones are
+// counted in days from the Unix epoch.
+func periodStart(t time.Time, interval time.Duration) time.Time {
+	const day = 24 * time.Hour
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch {
+	case interval <= 0 || interval == day:
+		return midnight
+	case interval < day:
+		return midnight.Add(t.Sub(midnight).Truncate(interval))
+	default:
+		days := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / int64(day/time.Second)
+		days -= days % int64(interval/day)
+		return time.Date(1970, 1, 1+int(days), 0, 0, 0, 0, t.Location())
+	}
+}
+
+// periodLayout returns the time layout of the rotated file names, with the
+// hour, or the minute, for the intervals shorter than a day, or an hour.
+func periodLayout(interval time.Duration) string {
+	switch {
+	case interval <= 0 || interval >= 24*time.Hour:
+		return FileDateTimeFormat
+	case interval >= time.Hour:
+		return FileDateTimeFormat + "_15"
+	default:
+		return FileDateTimeFormat + "_15-04"
+	}
+}
+
+func inZone(t time.Time, utc bool) time.Time {
+	if utc {
+		return t.UTC()
+	}
+
+	return t.Local()
+}
+
+// createFile creates the file and its directory with the configured
+// permissions, before filerotate opens it.
+func createFile(path string, cfg fileConfig) {
+	if err := os.MkdirAll(filepath.Dir(path), cfg.dirMode); err != nil {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, cfg.fileMode)
+	if err != nil {
+		return
+	}
+	file.Close()
+}
+
 func findModuleRoot() string {
 	dir, _ := os.Getwd()
 	for {
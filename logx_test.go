@@ -1,12 +1,23 @@
 package logx_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"log/slog"
+	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alex-cos/logx"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestConsole(t *testing.T) {
@@ -32,3 +43,697 @@ func TestFile(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestHandlerOptions(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "Debug", true, true,
+		logx.WithHandlerOptions(func(o *slog.HandlerOptions) {
+			o.Level = slog.LevelWarn
+		}),
+	)
+
+	logger.Info("Hidden")
+	logger.Warn("Shown")
+
+	if strings.Contains(buf.String(), "Hidden") || !strings.Contains(buf.String(), "Shown") {
+		t.Fatalf("level from handler options not honored: %s", buf.String())
+	}
+}
+
+func TestColorMode(t *testing.T) {
+	t.Parallel()
+
+	var always, auto bytes.Buffer
+	logx.New([]io.Writer{&always}, "Debug", false, true, logx.WithColorMode(logx.ColorAlways)).Error("Test")
+	logx.New([]io.Writer{&auto}, "Debug", false, true, logx.WithColorMode(logx.ColorAuto)).Error("Test")
+
+	if !strings.Contains(always.String(), "level=\x1b[31merror\x1b[0m ") {
+		t.Fatalf("expected a colorized level, got %q", always.String())
+	}
+	if strings.Contains(auto.String(), "\x1b[") {
+		t.Fatalf("expected no color for a non terminal output, got %q", auto.String())
+	}
+}
+
+func TestFileNestedDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "a", "b", "c")
+	file, closeFile := logx.NewFileRotate(filepath.Join(dir, "app.log"), true,
+		logx.WithDirMode(0o700),
+		logx.WithFileMode(0o600),
+	)
+	logx.New([]io.Writer{file}, "Debug", true, true).Info("Test")
+	closeFile()
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Fatalf("unexpected directory mode %s", info.Mode().Perm())
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "app_*.log"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one log file, got %v", matches)
+	}
+	info, err = os.Stat(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("unexpected file mode %s", info.Mode().Perm())
+	}
+	content, _ := os.ReadFile(matches[0])
+	if !strings.Contains(string(content), `"msg":"Test"`) {
+		t.Fatalf("unexpected file content %q", content)
+	}
+}
+
+// TestSetDefault changes the default logger, so it does not run in parallel.
+func TestSetDefault(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	var buf bytes.Buffer
+	logx.SetDefault(logx.New([]io.Writer{&buf}, "Info", true, true,
+		logx.WithHandlerOptions(func(o *slog.HandlerOptions) {
+			o.AddSource = true
+		}),
+	))
+
+	logx.Debug("Hidden")
+	logx.Info("Info message", "key", "value")
+	logx.Warn("Warn message")
+	logx.ErrorMsg("Error message")
+
+	out := buf.String()
+	for _, want := range []string{`"msg":"Info message"`, `"key":"value"`, `"msg":"Warn message"`, `"msg":"Error message"`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %s in %s", want, out)
+		}
+	}
+	if strings.Contains(out, "Hidden") {
+		t.Fatalf("debug message logged at info level: %s", out)
+	}
+	if !strings.Contains(out, "logx_test.go") {
+		t.Fatalf("source does not point to the caller: %s", out)
+	}
+}
+
+func TestRotationUTCDayBoundary(t *testing.T) {
+	t.Parallel()
+
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	// Both times are on January 2nd in UTC+2, but on each side of the UTC
+	// midnight.
+	created := time.Date(2025, 1, 1, 23, 30, 0, 0, time.UTC).In(zone)
+	now := time.Date(2025, 1, 2, 0, 10, 0, 0, time.UTC).In(zone)
+
+	if name := logx.RotationName("app", ".log", created, now, true); name != "app_2025-01-02.log" {
+		t.Fatalf("expected a rotation to the UTC day, got %q", name)
+	}
+	if name := logx.RotationName("app", ".log", now, now.Add(time.Hour), true); name != "" {
+		t.Fatalf("unexpected rotation within the UTC day: %q", name)
+	}
+	created = time.Date(2025, 1, 2, 23, 30, 0, 0, time.UTC)
+	if name := logx.RotationName("app", ".log", created, created.Add(time.Hour), true); name != "app_2025-01-03.log" {
+		t.Fatalf("expected the name to use the UTC day, got %q", name)
+	}
+	if name := logx.RotationName("app", ".log", created, created.AddDate(1, 0, 0), true); name != "app_2026-01-02.log" {
+		t.Fatalf("expected a rotation a year later, got %q", name)
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	t.Parallel()
+
+	record := func(logger *slog.Logger, buf *bytes.Buffer) map[string]any {
+		t.Helper()
+
+		logger.Debug("Hidden")
+		logger.Warn("Shown", "key", "value")
+		var values map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+			t.Fatalf("expected a single JSON record: %v", err)
+		}
+		delete(values, "time")
+		return values
+	}
+
+	var positional, options bytes.Buffer
+	want := record(logx.New([]io.Writer{&positional}, "Info", true, true), &positional)
+	got := record(logx.NewWithOptions([]io.Writer{&options},
+		logx.WithLevel("Info"),
+		logx.WithJSON(true),
+		logx.WithUTC(true),
+	), &options)
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("records differ:\n%v\n%v", got, want)
+	}
+	if got["msg"] != "Shown" || got["caller"] == nil {
+		t.Fatalf("unexpected record: %v", got)
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "Info", true, true, logx.WithTraceContext(true))
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+		TraceState: trace.TraceState{},
+		Remote:     false,
+	})
+	logger.With("key", "value").InfoContext(trace.ContextWithSpanContext(context.Background(), sc), "Traced")
+	logger.Info("Untraced")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var traced, untraced map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &traced); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &untraced); err != nil {
+		t.Fatal(err)
+	}
+	if traced[logx.STraceID] != sc.TraceID().String() || traced[logx.SSpanID] != sc.SpanID().String() || traced["key"] != "value" {
+		t.Fatalf("unexpected traced record: %v", traced)
+	}
+	if _, ok := untraced[logx.STraceID]; ok {
+		t.Fatalf("unexpected trace id without a span: %v", untraced)
+	}
+}
+
+func TestFileRotateSize(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	line := strings.Repeat("x", 59) + "\n"
+	file, closeFile := logx.NewFileRotateSize(filepath.Join(dir, "app.log"), true, 100)
+	for range 5 {
+		if _, err := io.WriteString(file, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeFile()
+
+	day := time.Now().UTC().Format(logx.FileDateTimeFormat)
+	for name, size := range map[string]int64{
+		"app_" + day + ".log":   120,
+		"app_" + day + ".1.log": 120,
+		"app_" + day + ".2.log": 60,
+	} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != size {
+			t.Fatalf("unexpected size %d of %s", info.Size(), name)
+		}
+	}
+
+	// A restart goes on with the last file of the day not full.
+	file, closeFile = logx.NewFileRotateSize(filepath.Join(dir, "app.log"), true, 100)
+	io.WriteString(file, line) // nolint: errcheck
+	closeFile()
+	if info, err := os.Stat(filepath.Join(dir, "app_"+day+".2.log")); err != nil || info.Size() != 120 {
+		t.Fatalf("expected the restart to append to the last file: %v", err)
+	}
+}
+
+func TestFileRetention(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+	name := func(daysAgo int, suffix string) string {
+		return "app_" + now.AddDate(0, 0, -daysAgo).Format(logx.FileDateTimeFormat) + suffix + ".log"
+	}
+	create := func(dir string, names ...string) {
+		for _, n := range names {
+			if err := os.WriteFile(filepath.Join(dir, n), []byte("old\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	remaining := func(dir string) []string {
+		var names []string
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	byCount := t.TempDir()
+	create(byCount, name(3, ""), name(2, ""), name(2, ".1"), "other.log", "app_notes.log")
+	_, closeFile := logx.NewFileRotate(filepath.Join(byCount, "app.log"), true, logx.WithMaxFiles(3))
+	closeFile()
+	want := []string{name(0, ""), name(2, ""), name(2, ".1"), "app_notes.log", "other.log"}
+	slices.Sort(want)
+	if got := remaining(byCount); !slices.Equal(got, want) {
+		t.Fatalf("unexpected files %v, want %v", got, want)
+	}
+
+	byAge := t.TempDir()
+	create(byAge, name(10, ""), name(6, ".3"), name(5, ""), name(1, ""))
+	_, closeFile = logx.NewFileRotate(filepath.Join(byAge, "app.log"), true, logx.WithMaxAge(5))
+	closeFile()
+	want = []string{name(5, ""), name(1, ""), name(0, "")}
+	slices.Sort(want)
+	if got := remaining(byAge); !slices.Equal(got, want) {
+		t.Fatalf("unexpected files %v, want %v", got, want)
+	}
+}
+
+func TestFileCompress(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	file, closeFile := logx.NewFileRotateSize(filepath.Join(dir, "app.log"), true, 10, logx.WithCompress(true))
+	for _, line := range []string{"first line\n", "second line\n"} {
+		if _, err := io.WriteString(file, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeFile()
+
+	day := time.Now().UTC().Format(logx.FileDateTimeFormat)
+	if _, err := os.Stat(filepath.Join(dir, "app_"+day+".log")); !os.IsNotExist(err) {
+		t.Fatalf("expected the rotated file to be replaced: %v", err)
+	}
+	gz, err := os.Open(filepath.Join(dir, "app_"+day+".log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(zr)
+	if err != nil || string(content) != "first line\n" {
+		t.Fatalf("unexpected compressed content %q (%v)", content, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "app_"+day+".1.log")); string(content) != "second line\n" {
+		t.Fatalf("unexpected current file content %q", content)
+	}
+}
+
+func TestFileCompressRetention(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	file, closeFile := logx.NewFileRotateSize(filepath.Join(dir, "app.log"), true, 10,
+		logx.WithCompress(true), logx.WithMaxFiles(2))
+	for i := range 8 {
+		if _, err := fmt.Fprintf(file, "line number %d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeFile()
+
+	day := time.Now().UTC().Format(logx.FileDateTimeFormat)
+	var names []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"app_" + day + ".6.log.gz", "app_" + day + ".7.log"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("unexpected files %v, want %v", names, want)
+	}
+}
+
+func TestRotationInterval(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2025, 1, 2, 15, 10, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		interval time.Duration
+		now      time.Time
+		want     string
+	}{
+		{time.Hour, created.Add(30 * time.Minute), ""},
+		{time.Hour, created.Add(50 * time.Minute), "app_2025-01-02_16.log"},
+		{2 * time.Hour, created.Add(30 * time.Minute), ""},
+		{2 * time.Hour, created.Add(2 * time.Hour), "app_2025-01-02_16.log"},
+		{15 * time.Minute, created.Add(5 * time.Minute), "app_2025-01-02_15-15.log"},
+		{7 * 24 * time.Hour, created.AddDate(0, 0, 1), ""},
+		{7 * 24 * time.Hour, created.AddDate(0, 0, 7), "app_2025-01-09.log"},
+	} {
+		if name := logx.RotationNameInterval("app", ".log", created, tc.now, true, tc.interval); name != tc.want {
+			t.Fatalf("unexpected rotation every %s at %s: %q, want %q", tc.interval, tc.now, name, tc.want)
+		}
+	}
+
+	dir := t.TempDir()
+	file, closeFile := logx.NewFileRotateInterval(filepath.Join(dir, "app.log"), true, time.Hour)
+	logx.New([]io.Writer{file}, "Debug", true, true).Info("Test")
+	closeFile()
+	matches, _ := filepath.Glob(filepath.Join(dir, "app_*_[0-9][0-9].log"))
+	if len(matches) != 1 {
+		t.Fatalf("expected an hourly log file, got %v", matches)
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logx.New([]io.Writer{&buf}, "Info", true, true, logx.WithTimeFormat(logx.DateTimeFormatMicro)).Info("Test")
+	var values map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	ts, _ := values["time"].(string)
+	if _, err := time.Parse(logx.DateTimeFormatMicro, ts); err != nil {
+		t.Fatalf("expected a time with microseconds, got %q", ts)
+	}
+
+	loki, captured := logx.NewLokiTestClient()
+	if _, err := loki.Write(buf.Bytes()); err != nil {
+		t.Fatalf("expected the Loki client to parse the time: %v", err)
+	}
+	if values := captured(); len(values) != 1 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+}
+
+func TestWithoutSource(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logx.New([]io.Writer{&buf}, "Info", true, true, logx.WithSource(false)).Info("Test")
+	var values map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["caller"]; ok {
+		t.Fatalf("unexpected caller without source: %v", values)
+	}
+}
+
+func TestCallerKey(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logx.New([]io.Writer{&buf}, "Info", true, true, logx.WithCallerKey("source")).Info("Test")
+	var values map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	if caller, ok := values["source"].(string); !ok || !strings.HasPrefix(caller, "logx_test.go:") {
+		t.Fatalf("unexpected source: %v", values)
+	}
+	if _, ok := values[logx.SCaller]; ok {
+		t.Fatalf("unexpected caller key: %v", values)
+	}
+}
+
+// TestFatal replaces the exit function, so it does not run in parallel.
+func TestFatal(t *testing.T) {
+	var code int
+	restore := logx.SetExit(func(c int) { code = c })
+	defer restore()
+	var buf bytes.Buffer
+	var flushed []string
+	logger := logx.New([]io.Writer{&buf}, "Info", true, true)
+	logx.AtExit(func() { flushed = append(flushed, "first") })
+	logx.AtExit(func() { flushed = append(flushed, "second") })
+
+	logx.Fatal(logger, "Fatal", "key", "value")
+
+	var values map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	if values["level"] != "fatal" || values["key"] != "value" || !strings.HasPrefix(values["caller"].(string), "logx_test.go:") {
+		t.Fatalf("unexpected record: %v", values)
+	}
+	if !slices.Equal(flushed, []string{"second", "first"}) || code != 1 {
+		t.Fatalf("unexpected exit: flushed %v, code %d", flushed, code)
+	}
+}
+
+func TestCustomLevels(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "trace", false, true)
+	logger.Log(context.Background(), logx.LevelTrace, "Traced")
+	logger.Log(context.Background(), logx.LevelFatal, "Fatal")
+
+	if out := buf.String(); !strings.Contains(out, "level=trace ") || !strings.Contains(out, "level=fatal ") {
+		t.Fatalf("expected the custom level names, got %q", out)
+	}
+	if level, err := logx.ParseLevelStrict("FATAL"); err != nil || level != logx.LevelFatal {
+		t.Fatalf("unexpected level %s (%v)", level, err)
+	}
+}
+
+// stackError mimics the errors of pkg/errors, which record their stack.
+type stackError struct {
+	pcs []uintptr
+}
+
+type stackFrame uintptr
+
+func (e stackError) Error() string {
+	return "stack error"
+}
+
+func (e stackError) StackTrace() []stackFrame {
+	frames := make([]stackFrame, len(e.pcs))
+	for i, pc := range e.pcs {
+		frames[i] = stackFrame(pc)
+	}
+	return frames
+}
+
+func newStackError() error {
+	pcs := make([]uintptr, 32)
+	return stackError{pcs: pcs[:runtime.Callers(1, pcs)]}
+}
+
+func TestStackTrace(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "Info", true, true, logx.WithStackTrace(slog.LevelError))
+	records := func() []map[string]any {
+		var records []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var values map[string]any
+			if err := json.Unmarshal([]byte(line), &values); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, values)
+		}
+		buf.Reset()
+		return records
+	}
+
+	logger.Info("No stack")
+	logger.Error("Caller stack")
+	logger.Error("Error stack", logx.Error(fmt.Errorf("wrapped: %w", newStackError())))
+	got := records()
+
+	if _, ok := got[0][logx.SStackTrace]; ok {
+		t.Fatalf("unexpected stack below the min level: %v", got[0])
+	}
+	if stack, _ := got[1][logx.SStackTrace].(string); !strings.HasPrefix(stack, "github.com/alex-cos/logx_test.TestStackTrace") {
+		t.Fatalf("expected the stack to start at the logging call, got %q", stack)
+	}
+	if stack, _ := got[2][logx.SStackTrace].(string); !strings.HasPrefix(stack, "github.com/alex-cos/logx_test.newStackError") {
+		t.Fatalf("expected the stack of the error, got %q", stack)
+	}
+}
+
+func TestRedactKeys(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "Info", true, true, logx.WithRedactKeys("password", "Authorization", "request.token"))
+	logger.Info("Login",
+		"PASSWORD", "secret",
+		slog.Group("request", "authorization", "Bearer secret", "token", "secret", "path", "/login"),
+		slog.Group("session", "token", "kept"),
+	)
+
+	var values map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	request, _ := values["request"].(map[string]any)
+	session, _ := values["session"].(map[string]any)
+	if values["PASSWORD"] != "***" || request["authorization"] != "***" || request["token"] != "***" {
+		t.Fatalf("expected the sensitive fields to be redacted: %v", values)
+	}
+	if request["path"] != "/login" || session["token"] != "kept" {
+		t.Fatalf("unexpected redaction: %v", values)
+	}
+
+	// The builtin attributes are kept, whatever the case of the keys.
+	buf.Reset()
+	logx.New([]io.Writer{&buf}, "Info", true, true, logx.WithRedactKeys("TIME", "level", "msg", "caller")).Info("Login")
+	values = nil
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	if values["time"] == "***" || values["level"] != "info" || values["msg"] != "Login" {
+		t.Fatalf("unexpected redaction of the builtin attributes: %v", values)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "Debug", false, true, logx.WithSampling(3))
+	child := logger.With("key", "value")
+	for i := range 6 {
+		logger.Info("info")
+		child.Debug("debug")
+		if i%2 == 0 {
+			child.Info("info")
+		}
+		logger.Warn("warn")
+	}
+
+	out := buf.String()
+	counts := map[string]int{
+		"info":  strings.Count(out, "msg=info"),
+		"debug": strings.Count(out, "msg=debug"),
+		"warn":  strings.Count(out, "msg=warn"),
+	}
+	if counts["info"] != 3 || counts["debug"] != 2 || counts["warn"] != 6 {
+		t.Fatalf("unexpected sampled counts: %v", counts)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "Debug", false, true, logx.WithFilter(
+		func(_ context.Context, r slog.Record) bool {
+			keep := true
+			r.Attrs(func(a slog.Attr) bool {
+				if a.Key == "component" && a.Value.String() == "gorm" {
+					keep = false
+				}
+
+				return keep
+			})
+
+			return keep
+		}))
+	logger.Info("Query", "component", "gorm")
+	logger.With("component", "gorm").WithGroup("db").Info("Prepared")
+	logger.Info("Request", "component", "http")
+
+	if out := buf.String(); strings.Contains(out, "Query") || strings.Contains(out, "Prepared") || !strings.Contains(out, "Request") {
+		t.Fatalf("unexpected filtered log %q", out)
+	}
+}
+
+func TestLevelRouted(t *testing.T) {
+	t.Parallel()
+
+	var main, errs bytes.Buffer
+	logger := logx.NewLevelRouted(map[slog.Level][]io.Writer{
+		slog.LevelInfo:  {&main},
+		slog.LevelError: {&errs},
+	}, logx.WithJSON(true)).With("service", "api")
+	logger.Debug("Hidden")
+	logger.Info("Started")
+	logger.Error("Failed")
+
+	if out := main.String(); strings.Contains(out, "Hidden") || !strings.Contains(out, "Started") || !strings.Contains(out, "Failed") {
+		t.Fatalf("unexpected main log %q", out)
+	}
+	if out := errs.String(); strings.Contains(out, "Started") || !strings.Contains(out, `"service":"api"`) {
+		t.Fatalf("unexpected error log %q", out)
+	}
+}
+
+func TestErrorWriter(t *testing.T) {
+	t.Parallel()
+
+	var errs bytes.Buffer
+	logger, closeFile := logx.NewFileLogger(filepath.Join(t.TempDir(), "app.log"), "Info", false, true, false,
+		logx.WithErrorWriter(&errs, slog.LevelWarn),
+	)
+	defer closeFile()
+	logger.Info("Started")
+	logger.Warn("Slow")
+	logger.Error("Failed")
+
+	if out := errs.String(); strings.Contains(out, "Started") || !strings.Contains(out, "Slow") || !strings.Contains(out, "Failed") {
+		t.Fatalf("unexpected error stream %q", out)
+	}
+
+	// The error stream duplicates the records, it does not lower the level.
+	var main, quiet bytes.Buffer
+	logger = logx.New([]io.Writer{&main}, "Error", false, true, logx.WithErrorWriter(&quiet, slog.LevelWarn))
+	logger.Warn("Slow")
+	logger.Error("Failed")
+	if out := quiet.String(); strings.Contains(out, "Slow") || !strings.Contains(out, "Failed") || main.String() != out {
+		t.Fatalf("unexpected streams %q and %q", main.String(), out)
+	}
+}
+
+func TestWithGroup(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "Info", true, true, logx.WithGroup("http"))
+	logger.Info("Request", "method", "GET", "time", "12ms", "level", "L7")
+
+	var values map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	group, _ := values["http"].(map[string]any)
+	if group["method"] != "GET" || group["time"] != "12ms" || group["level"] != "L7" {
+		t.Fatalf("expected the attributes under the group, untouched: %v", values)
+	}
+	if values["level"] != "info" || values["msg"] != "Request" || values["caller"] == nil {
+		t.Fatalf("expected the builtin attributes at the top level: %v", values)
+	}
+}
+
+func TestWithGroupTopLevelAttributes(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logx.New([]io.Writer{&buf}, "Info", true, true,
+		logx.WithGroup("http"), logx.WithTraceContext(true), logx.WithStackTrace(slog.LevelError))
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+		TraceState: trace.TraceState{},
+		Remote:     false,
+	})
+	logger.With("id", 7).WithGroup("resp").ErrorContext(trace.ContextWithSpanContext(context.Background(), sc), "Failed", "status", 500)
+
+	var values map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	if values[logx.STraceID] != sc.TraceID().String() || values[logx.SSpanID] != sc.SpanID().String() || values[logx.SStackTrace] == nil {
+		t.Fatalf("expected the trace and stack attributes at the top level: %v", values)
+	}
+	group, _ := values["http"].(map[string]any)
+	resp, _ := group["resp"].(map[string]any)
+	if group["id"] != float64(7) || len(group) != 2 || resp["status"] != float64(500) {
+		t.Fatalf("expected only the record attributes under the group: %v", values)
+	}
+}
@@ -2,46 +2,208 @@ package logx
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	crand "crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	baseURL = "loki/api/v1"
+
+	maxResponseHookBytes = 64 * 1024
+	entryOverhead        = 64
+	maxTrackedStreams    = 1000
+	maxRetryQueue        = 100
+	idempotencyHeader    = "X-Loki-Idempotency-Key"
 )
 
-type lokiRequest struct {
-	Streams []lokiStream `json:"streams"`
-}
+// labelNameRegexp matches the label names accepted by Loki.
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 
-type lokiStream struct {
-	Stream map[string]string `json:"stream"`
-	Values [][]any           `json:"values"`
-}
+// InvalidUTF8 tells how invalid UTF-8 sequences of written records are handled.
+type InvalidUTF8 int
+
+const (
+	// InvalidUTF8Keep leaves the input as is, the invalid bytes reaching Loki
+	// with WithProtobuf only: decoding a JSON record, like encoding the JSON
+	// push of a raw line, replaces each of them with U+FFFD.
+	InvalidUTF8Keep InvalidUTF8 = iota
+	// InvalidUTF8Replace replaces invalid sequences with U+FFFD.
+	InvalidUTF8Replace
+	// InvalidUTF8Escape replaces each invalid byte with its \xNN escape.
+	InvalidUTF8Escape
+)
+
+// QueueFullPolicy tells what Write does when the buffer is full.
+type QueueFullPolicy int
+
+const (
+	// QueueTimeout waits up to the write timeout, then drops the new entry.
+	QueueTimeout QueueFullPolicy = iota
+	// QueueDropNewest drops the new entry right away.
+	QueueDropNewest
+	// QueueDropOldest evicts the oldest buffered entries to make room.
+	QueueDropOldest
+	// QueueBlock waits until there is room.
+	QueueBlock
+)
+
+// expired is a closed channel, for timeouts which are already reached.
+var expired = func() chan time.Time {
+	ch := make(chan time.Time)
+	close(ch)
+	return ch
+}()
+
+// DuplicateTimestamp tells what to do with an entry sharing the timestamp of
+// the previous entry of its stream.
+type DuplicateTimestamp int
+
+const (
+	// DuplicateIncrement nudges the duplicate timestamp to one nanosecond
+	// after the last one sent for the stream.
+	DuplicateIncrement DuplicateTimestamp = iota
+	// DuplicateDrop drops the duplicate entry.
+	DuplicateDrop
+	// DuplicateKeep sends the entry as is.
+	DuplicateKeep
+)
+
+// SchemaViolation tells what to do with a record missing a required field.
+type SchemaViolation int
+
+const (
+	// SchemaViolationMark sends the record with a __schema_violation__
+	// metadata listing the missing fields.
+	SchemaViolationMark SchemaViolation = iota
+	// SchemaViolationDrop drops the record, Write returning
+	// ErrSchemaViolation.
+	SchemaViolationDrop
+)
+
+// ErrStopTimeout is returned by CloseE when the stop timeout expires before
+// the buffer is drained.
+var ErrStopTimeout = errors.New("stop timed out")
+
+// ErrSchemaViolation is returned by Write for a record missing a required
+// field, with SchemaViolationDrop.
+var ErrSchemaViolation = errors.New("missing required fields")
 
 type LokiClient struct {
-	host         string
-	port         int
+	endpoints    []string
+	endpoint     atomic.Int32
 	useHTTPS     bool
+	pathPrefix   string
+	idempotency  bool
 	username     string
 	password     string
 	bearer       string
+	tenant       string
+	userAgent    string
 	httpClient   *http.Client
+	tlsConfig    *tls.Config
+	proxy        func(*http.Request) (*url.URL, error)
+	serializer   Serializer
+	contentType  string
+	gzipLevel    int
+	gzipBuf      bytes.Buffer
+	gzipWriter   *gzip.Writer
 	labels       map[string]string
+	allowedKeys  map[string]struct{}
 	batchSize    int
+	maxBytes     int64
+	adaptiveMin  int
+	adaptiveMax  int
 	writeTimeout time.Duration
+	queuePolicy  QueueFullPolicy
 	sendTimeout  time.Duration
+	respTimeout  time.Duration
+	maxRetryTime time.Duration
+	backoff      Backoff
+	retries      int
+	backoffBase  time.Duration
+	backoffMax   time.Duration
+	retryMaxAge  time.Duration
+	breaker      *circuitBreaker
+	retryQueue   []failedBatch
+	diskDir      string
+	diskMax      int64
+	disk         *diskBuffer
 	period       time.Duration
-	buffer       chan []any
+	maxSkew      time.Duration
+	jitter       float64
+	successCodes []int
+	emptyBody    bool
+	responseHook func(resp *http.Response)
+	failedParser func(body []byte, streams int) []int
+	capture      func(streams []LokiStream)
+	tracer       trace.Tracer
+	timeField    string
+	timeLayout   string
+	msgField     string
+	lineFunc     func(values map[string]any) string
+	levelMapper  func(n float64) slog.Level
+	enrichment   func(ctx context.Context, values map[string]any)
+	required     []string
+	onViolation  SchemaViolation
+	jsonLine     bool
+	rawLines     bool
+	splitArrays  bool
+	maxDepth     int
+	metadata     bool
+	invalidUTF8  InvalidUTF8
+	maxLineBytes int
+	splitLines   bool
+	duplicates   DuplicateTimestamp
+	timestamps   map[string]*streamTimestamps
+	diagnostics  io.Writer
+	onClose      func()
+	onDrop       func(entry []byte)
+	onError      func(err error)
+	lastErr      error
+	closeErr     error
+	dropReport   bool
+	lastDrops    int64
+	stopTimeout  time.Duration
+	abort        chan struct{}
+	flushes      chan chan error
+	finished     chan struct{}
+	warmup       bool
+	autoLabels   []string
+	maxStreams   int
+	buffer       chan lokiEntry
+	namespace    string
+	metrics      lokiCounters
+	maxMemory    int64
+	memory       atomic.Int64
+	memoryFreed  chan struct{}
 	wg           sync.WaitGroup
 	once         sync.Once
 }
@@ -58,6 +220,23 @@ func WithHTTPS(b bool) Option {
 	}
 }
 
+// WithPathPrefix sets the API path the push path is appended to, for a Loki
+// behind a reverse proxy. Defaults to loki/api/v1.
+func WithPathPrefix(prefix string) Option {
+	return func(c *LokiClient) {
+		c.pathPrefix = strings.Trim(prefix, "/")
+	}
+}
+
+// WithIdempotencyKey adds a per-batch X-Loki-Idempotency-Key header which
+// stays the same across the retries of a batch, a new one being used when
+// only its failed streams are retried.
+func WithIdempotencyKey(b bool) Option {
+	return func(c *LokiClient) {
+		c.idempotency = b
+	}
+}
+
 func WithBasicAuth(username, password string) Option {
 	return func(c *LokiClient) {
 		c.username = username
@@ -71,6 +250,32 @@ func WithBearerToken(token string) Option {
 	}
 }
 
+// WithTenantID sets the X-Scope-OrgID header of a multi-tenant Loki.
+func WithTenantID(tenant string) Option {
+	return func(c *LokiClient) {
+		c.tenant = tenant
+	}
+}
+
+// WithFallbackEndpoints adds host:port endpoints to switch to, in order, when
+// the retries on the current one are exhausted. The client stays on the
+// endpoint which last succeeded.
+func WithFallbackEndpoints(endpoints ...string) Option {
+	return func(c *LokiClient) {
+		c.endpoints = append(c.endpoints, endpoints...)
+	}
+}
+
+// WithUserAgent sets the User-Agent header of the requests. Defaults to
+// GoLokiClient.
+func WithUserAgent(agent string) Option {
+	return func(c *LokiClient) {
+		if agent != "" {
+			c.userAgent = agent
+		}
+	}
+}
+
 func WithLabels(labels map[string]string) Option {
 	return func(c *LokiClient) {
 		for k, v := range labels {
@@ -79,6 +284,92 @@ func WithLabels(labels map[string]string) Option {
 	}
 }
 
+// hostname resolves the host name once for all the clients.
+var hostname = sync.OnceValues(os.Hostname)
+
+// WithHostnameLabel adds the host name as a label under key, "host" when
+// empty. The label is omitted when the host name cannot be resolved.
+func WithHostnameLabel(key string) Option {
+	return func(c *LokiClient) {
+		if key == "" {
+			key = "host"
+		}
+		name, err := hostname()
+		if err != nil || name == "" {
+			c.diagf("cannot resolve the host name, omitting the %q label: %v\n", key, err)
+			return
+		}
+		c.labels[key] = name
+	}
+}
+
+// resourceLabels maps well-known OpenTelemetry resource attributes to the
+// conventional Loki label names.
+var resourceLabels = map[string]string{
+	"service.name":                "service",
+	"service.namespace":           "namespace",
+	"service.version":             "version",
+	"service.instance.id":         "instance",
+	"deployment.environment":      "env",
+	"deployment.environment.name": "env",
+	"host.name":                   "host",
+	"k8s.namespace.name":          "k8s_namespace",
+	"k8s.pod.name":                "pod",
+	"k8s.container.name":          "container",
+	"cloud.region":                "region",
+}
+
+// WithResource adds labels from OpenTelemetry resource attributes. Well-known
+// keys are renamed (service.name becomes service, etc.), the dots of other
+// keys are replaced with underscores.
+func WithResource(attributes map[string]string) Option {
+	return func(c *LokiClient) {
+		for k, v := range attributes {
+			label, ok := resourceLabels[k]
+			if !ok {
+				label = strings.ReplaceAll(k, ".", "_")
+			}
+			c.labels[label] = v
+		}
+	}
+}
+
+// WithAutoLabelKeys promotes the listed record attributes, typically set with
+// slog's Logger.With, to stream labels instead of structured metadata.
+// Each distinct label set is a Loki stream: keep the values of these
+// attributes few, and bound the streams of a batch with WithMaxStreams.
+func WithAutoLabelKeys(keys ...string) Option {
+	return func(c *LokiClient) {
+		c.autoLabels = append(c.autoLabels, keys...)
+	}
+}
+
+// WithDynamicLabels is WithAutoLabelKeys.
+func WithDynamicLabels(keys ...string) Option {
+	return WithAutoLabelKeys(keys...)
+}
+
+// WithMaxStreams sends the batch early when an entry would bring its number
+// of distinct streams over n.
+func WithMaxStreams(n int) Option {
+	return func(c *LokiClient) {
+		if n > 0 {
+			c.maxStreams = n
+		}
+	}
+}
+
+// WithAllowedLabelKeys restricts the label keys that may be sent to Loki.
+// Labels with any other key are dropped with a warning.
+func WithAllowedLabelKeys(keys ...string) Option {
+	return func(c *LokiClient) {
+		c.allowedKeys = make(map[string]struct{}, len(keys))
+		for _, k := range keys {
+			c.allowedKeys[k] = struct{}{}
+		}
+	}
+}
+
 func WithHttpClient(httpClient *http.Client) Option {
 	return func(c *LokiClient) {
 		if httpClient != nil {
@@ -87,6 +378,81 @@ func WithHttpClient(httpClient *http.Client) Option {
 	}
 }
 
+// WithTLSConfig sets the TLS configuration, e.g. a private root CA or a client
+// certificate, of the default HTTP client. It is ignored when an HTTP client
+// is given with WithHttpClient.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *LokiClient) {
+		c.tlsConfig = config
+	}
+}
+
+// WithProxy sends the requests through the HTTP proxy at proxyURL, or the
+// one of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables when
+// empty. Ignored with a client set by WithHttpClient.
+func WithProxy(proxyURL string) Option {
+	return func(c *LokiClient) {
+		if proxyURL == "" {
+			c.proxy = http.ProxyFromEnvironment
+			return
+		}
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			err = fmt.Errorf("invalid proxy URL: %w", err)
+			c.proxy = func(*http.Request) (*url.URL, error) {
+				return nil, err
+			}
+			return
+		}
+		c.proxy = http.ProxyURL(u)
+	}
+}
+
+func WithSerializer(s Serializer) Option {
+	return func(c *LokiClient) {
+		if s != nil {
+			c.serializer = s
+		}
+	}
+}
+
+// WithProtobuf sends the push requests in the snappy compressed protobuf
+// format instead of JSON.
+func WithProtobuf() Option {
+	return WithSerializer(ProtobufSerializer{})
+}
+
+// WithContentType overrides the Content-Type header of push requests, e.g.
+// "application/json; charset=utf-8" for strict gateways.
+func WithContentType(ct string) Option {
+	return func(c *LokiClient) {
+		c.contentType = ct
+	}
+}
+
+// WithGzip compresses the push requests with gzip, at the default
+// compression level unless set by WithGzipLevel.
+func WithGzip(b bool) Option {
+	return func(c *LokiClient) {
+		switch {
+		case !b:
+			c.gzipLevel = 0
+		case c.gzipLevel == 0:
+			c.gzipLevel = gzip.DefaultCompression
+		}
+	}
+}
+
+// WithGzipLevel compresses the push requests with gzip at the given level,
+// from gzip.BestSpeed to gzip.BestCompression.
+func WithGzipLevel(level int) Option {
+	return func(c *LokiClient) {
+		if level >= gzip.BestSpeed && level <= gzip.BestCompression {
+			c.gzipLevel = level
+		}
+	}
+}
+
 func WithBatchSize(size int) Option {
 	return func(c *LokiClient) {
 		if size > 0 && size < 1000 {
@@ -95,6 +461,29 @@ func WithBatchSize(size int) Option {
 	}
 }
 
+// WithMaxBatchBytes sends the batch early when an entry would bring its
+// approximate size, lines and metadata plus a small overhead per entry, over
+// n bytes.
+func WithMaxBatchBytes(n int) Option {
+	return func(c *LokiClient) {
+		if n > 0 {
+			c.maxBytes = int64(n)
+		}
+	}
+}
+
+// WithAdaptiveBatching lets the client tune its batch size between minSize
+// and maxSize: it shrinks after failed or slow sends (over a tenth of the send
+// timeout) and grows after fast ones.
+func WithAdaptiveBatching(minSize, maxSize int) Option {
+	return func(c *LokiClient) {
+		if minSize > 0 && minSize <= maxSize {
+			c.adaptiveMin = minSize
+			c.adaptiveMax = maxSize
+		}
+	}
+}
+
 func WithPeriod(d time.Duration) Option {
 	return func(c *LokiClient) {
 		if d > 0 {
@@ -103,6 +492,16 @@ func WithPeriod(d time.Duration) Option {
 	}
 }
 
+// WithBatchJitter randomizes each flush period by up to the given fraction
+// of it, so that the flushes of replicas started together are spread out.
+func WithBatchJitter(fraction float64) Option {
+	return func(c *LokiClient) {
+		if fraction > 0 && fraction < 1 {
+			c.jitter = fraction
+		}
+	}
+}
+
 func WithWriteTimeout(d time.Duration) Option {
 	return func(c *LokiClient) {
 		if d > 0 {
@@ -111,6 +510,14 @@ func WithWriteTimeout(d time.Duration) Option {
 	}
 }
 
+// WithQueueFullPolicy sets the behavior of Write when the buffer is full.
+// The memory cap of WithMaxBufferMemory always drops the new entry.
+func WithQueueFullPolicy(p QueueFullPolicy) Option {
+	return func(c *LokiClient) {
+		c.queuePolicy = p
+	}
+}
+
 func WithSendTimeout(d time.Duration) Option {
 	return func(c *LokiClient) {
 		if d > 0 {
@@ -119,193 +526,1757 @@ func WithSendTimeout(d time.Duration) Option {
 	}
 }
 
-func WithBufferSize(size int) Option {
+// WithResponseHeaderTimeout bounds the wait for the response headers once a
+// push request is written, to fail fast on a server accepting the connection
+// but never answering. It applies to a copy of the HTTP client, which must
+// use an *http.Transport.
+func WithResponseHeaderTimeout(d time.Duration) Option {
 	return func(c *LokiClient) {
-		if size > 0 {
-			c.buffer = make(chan []any, size)
+		if d > 0 {
+			c.respTimeout = d
 		}
 	}
 }
 
-// -----------------------------------------------------------------------------
-// Constructor
-// -----------------------------------------------------------------------------
-
-func NewLokiClient(host string, port int, opts ...Option) (*LokiClient, Close) {
-	c := &LokiClient{
-		host:         host,
-		port:         port,
-		useHTTPS:     false,
-		username:     "",
-		password:     "",
-		bearer:       "",
-		httpClient:   http.DefaultClient,
-		labels:       make(map[string]string),
-		batchSize:    100,
-		writeTimeout: 100 * time.Millisecond,
-		sendTimeout:  5 * time.Second,
-		period:       15 * time.Second,
-		buffer:       make(chan []any, 1000),
-		wg:           sync.WaitGroup{},
-		once:         sync.Once{},
+// WithMaxRetryDuration bounds the wall-clock time spent sending a batch,
+// retries and failovers included. The batch is given up once the next attempt
+// would start after d, and an attempt still running at d is canceled.
+func WithMaxRetryDuration(d time.Duration) Option {
+	return func(c *LokiClient) {
+		if d > 0 {
+			c.maxRetryTime = d
+		}
 	}
+}
 
-	for _, o := range opts {
-		o(c)
+// WithBackoff sets the strategy deciding the retries of a failed push,
+// overriding WithRetries and WithBackoffBounds. Defaults to DefaultBackoff.
+func WithBackoff(b Backoff) Option {
+	return func(c *LokiClient) {
+		if b != nil {
+			c.backoff = b
+		}
 	}
-
-	c.wg.Add(1)
-	go c.run()
-
-	return c, c.stop
 }
 
-// -----------------------------------------------------------------------------
-// Public
-// -----------------------------------------------------------------------------
-
-func (c *LokiClient) Write(input []byte) (int, error) {
-	var values map[string]any
-
-	defer func() {
-		recover() // nolint: errcheck
-	}()
-
-	err := json.Unmarshal(input, &values)
-	if err != nil {
-		return 0, err
-	}
-	datetime, ok := values["time"]
-	if !ok {
-		return 0, errors.New("missing time parameter")
-	}
-	datetimeStr, ok := datetime.(string)
-	if !ok {
-		return 0, errors.New("wrong time format")
-	}
-	d, err := time.Parse(DateTimeFormatMilli, datetimeStr)
-	if err != nil {
-		return 0, err
+// WithRetries sets the number of retries of a failed push, 2 by default.
+func WithRetries(n int) Option {
+	return func(c *LokiClient) {
+		if n >= 0 {
+			c.retries = n
+		}
 	}
-	msg, ok := values["msg"]
-	if !ok {
-		return 0, errors.New("missing msg parameter")
+}
+
+// WithBackoffBounds retries the failed pushes with an exponential backoff,
+// from base up to maxDelay, with a random jitter up to 400ms.
+func WithBackoffBounds(base, maxDelay time.Duration) Option {
+	return func(c *LokiClient) {
+		if base > 0 && maxDelay >= base {
+			c.backoffBase = base
+			c.backoffMax = maxDelay
+		}
 	}
+}
 
-	delete(values, "time")
-	delete(values, "msg")
-	delete(values, "service")
+// WithRetryQueue keeps the batches which failed after their retries, up to
+// the 100 latest ones, and attempts to send them again at each flush period
+// until they are older than maxAge.
+func WithRetryQueue(maxAge time.Duration) Option {
+	return func(c *LokiClient) {
+		if maxAge > 0 {
+			c.retryMaxAge = maxAge
+		}
+	}
+}
 
-	for k, v := range values {
-		if _, ok := v.(string); !ok {
-			values[k] = fmt.Sprintf("%v", v)
+// WithCircuitBreaker stops pushing for cooldown after failures consecutive
+// failed pushes, failing the batches right away with ErrCircuitOpen, then
+// lets a single push test whether Loki has recovered.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(c *LokiClient) {
+		if failures > 0 && cooldown > 0 {
+			c.breaker = &circuitBreaker{
+				failures:    failures,
+				cooldown:    cooldown,
+				consecutive: 0,
+				openedAt:    time.Time{},
+			}
 		}
 	}
+}
 
-	msgStr, ok := msg.(string)
-	if !ok {
-		return 0, errors.New("wrong msg format")
+// WithDiskBuffer spills to an append-only file in dir the entries which
+// overflow the buffer or fail to be sent, up to maxBytes (0 for no limit),
+// and sends them again once Loki recovers. A file left by a previous run is
+// sent on startup.
+func WithDiskBuffer(dir string, maxBytes int64) Option {
+	return func(c *LokiClient) {
+		c.diskDir = dir
+		c.diskMax = maxBytes
 	}
+}
 
-	select {
-	case c.buffer <- []any{
-		strconv.FormatInt(d.UnixNano(), 10),
-		msgStr,
-		values,
-	}:
-	case <-time.After(c.writeTimeout):
-		fmt.Fprintf(os.Stderr, "[LokiClient] buffer is full, dropping log\n")
+// WithExpectedStatus sets the push response status codes counted as success.
+// Defaults to 200 and 204.
+func WithExpectedStatus(codes ...int) Option {
+	return func(c *LokiClient) {
+		if len(codes) > 0 {
+			c.successCodes = codes
+		}
 	}
+}
 
-	return len(input), nil
+// WithEmptyResponse makes a successful push response with a body a failure,
+// to catch proxies answering with an error page.
+func WithEmptyResponse(b bool) Option {
+	return func(c *LokiClient) {
+		c.emptyBody = b
+	}
 }
 
-// ----------------------------------------------------------------------------
-// Unexported functions
-// ----------------------------------------------------------------------------
+// WithFailedStreams retries only the failed streams of a batch when parse
+// finds their indices in the body of a failed push response, e.g.
+// ParseFailedStreams for a gateway in front of Loki listing them; Loki itself
+// does not. The whole batch is retried otherwise, and by default.
+func WithFailedStreams(parse func(body []byte, streams int) []int) Option {
+	return func(c *LokiClient) {
+		c.failedParser = parse
+	}
+}
 
-func (c *LokiClient) stop() {
-	c.once.Do(func() {
-		close(c.buffer)
-	})
-	c.wg.Wait()
+// WithResponseHook registers a function called with every push response,
+// successful or not. The body it sees is limited to the first 64KiB and is
+// closed by the client once the hook returns.
+func WithResponseHook(hook func(resp *http.Response)) Option {
+	return func(c *LokiClient) {
+		c.responseHook = hook
+	}
 }
 
-func (c *LokiClient) run() {
-	defer c.wg.Done()
+// WithTracer wraps each push attempt in a span of the tracer, recording the
+// batch size, the attempt number, the response status and the error, if any.
+func WithTracer(tracer trace.Tracer) Option {
+	return func(c *LokiClient) {
+		c.tracer = tracer
+	}
+}
 
-	waitCheck := time.NewTicker(c.period)
-	batch := [][]any{}
-	for {
-		select {
-		case e, ok := <-c.buffer:
-			if !ok {
-				c.sendBatch(batch)
-				return
-			}
-			batch = append(batch, e)
-			if len(batch) >= c.batchSize {
-				c.sendBatch(batch)
-				batch = batch[:0]
-			}
+// WithLineFunc renders the Loki line from all the parsed fields of a record,
+// instead of shipping its message. The map must not be retained.
+func WithLineFunc(fn func(values map[string]any) string) Option {
+	return func(c *LokiClient) {
+		c.lineFunc = fn
+	}
+}
 
-		case <-waitCheck.C:
-			c.sendBatch(batch)
-			batch = batch[:0]
+// WithTimeField sets the field the entry time is read from, for records of
+// other JSON producers. Defaults to time.
+func WithTimeField(name string) Option {
+	return func(c *LokiClient) {
+		if name != "" {
+			c.timeField = name
 		}
 	}
 }
 
-func (c *LokiClient) sendBatch(batch [][]any) {
-	var err error
-
-	if len(batch) == 0 {
-		return
+// WithTimeLayout sets the layout the entry time is parsed with, which must
+// match the WithTimeFormat of the logger. Defaults to time.RFC3339Nano, which
+// parses the DateTimeFormat layouts.
+func WithTimeLayout(layout string) Option {
+	return func(c *LokiClient) {
+		if layout != "" {
+			c.timeLayout = layout
+		}
 	}
-	for i := range 3 {
-		err = c.send(context.Background(), batch)
-		if err == nil {
-			return
+}
+
+// WithMessageField sets the field the entry line is read from. Defaults to
+// msg.
+func WithMessageField(name string) Option {
+	return func(c *LokiClient) {
+		if name != "" {
+			c.msgField = name
 		}
-		sleep := time.Second * time.Duration(i+1)
-		sleep += time.Duration(rand.Intn(400)) * time.Millisecond // nolint: gosec
-		time.Sleep(sleep)
 	}
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[LokiClient] failed to send batch: %v\n", err)
+}
+
+// WithTimeSkewCorrection clamps the record timestamps to within d of the
+// current time, so that a skewed clock does not get a batch rejected.
+func WithTimeSkewCorrection(d time.Duration) Option {
+	return func(c *LokiClient) {
+		if d > 0 {
+			c.maxSkew = d
+		}
 	}
 }
 
-func (c *LokiClient) send(ctx context.Context, batch [][]any) error {
-	ctx, cancel := context.WithTimeout(ctx, c.sendTimeout)
+// WithNumericLevels maps numeric level fields, as emitted by some producers,
+// to slog levels. BunyanLevel implements the bunyan/pino convention.
+func WithNumericLevels(mapper func(n float64) slog.Level) Option {
+	return func(c *LokiClient) {
+		c.levelMapper = mapper
+	}
+}
+
+// BunyanLevel maps bunyan/pino numeric levels (10 trace, 20 debug, 30 info,
+// 40 warn, 50 error, 60 fatal) to slog levels.
+func BunyanLevel(n float64) slog.Level {
+	switch {
+	case n < 30:
+		return slog.LevelDebug
+	case n < 40:
+		return slog.LevelInfo
+	case n < 50:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// WithEnrichment registers a function which may add fields to every parsed
+// record, typically from the context given to WriteContext. The map must not
+// be retained.
+func WithEnrichment(fn func(ctx context.Context, values map[string]any)) Option {
+	return func(c *LokiClient) {
+		c.enrichment = fn
+	}
+}
+
+// WithRequiredFields lists the fields every record must have, checked after
+// the enrichment hook. Raw lines are not checked.
+func WithRequiredFields(keys ...string) Option {
+	return func(c *LokiClient) {
+		c.required = append(c.required, keys...)
+	}
+}
+
+// WithSchemaViolation sets what to do with a record missing a required field.
+// Defaults to SchemaViolationMark.
+func WithSchemaViolation(v SchemaViolation) Option {
+	return func(c *LokiClient) {
+		c.onViolation = v
+	}
+}
+
+// WithJSONLine ships the whole record as a JSON line with a stable key order:
+// time, level and msg first, then the other fields sorted by key.
+func WithJSONLine(b bool) Option {
+	return func(c *LokiClient) {
+		c.jsonLine = b
+	}
+}
+
+// WithRawLines ships the written bytes verbatim as the Loki line, stamped
+// with the current time, without parsing them as JSON.
+func WithRawLines(b bool) Option {
+	return func(c *LokiClient) {
+		c.rawLines = b
+	}
+}
+
+// WithJSONArraySplit makes Write accept a JSON array of records, each one
+// becoming a separate entry. Records without a time share the time of the
+// write.
+func WithJSONArraySplit(b bool) Option {
+	return func(c *LokiClient) {
+		c.splitArrays = b
+	}
+}
+
+// WithStructuredMetadata toggles the shipping of the record fields as the
+// structured metadata of the entries, the third element of their values,
+// which Loki versions before 3.0 reject. On by default.
+func WithStructuredMetadata(b bool) Option {
+	return func(c *LokiClient) {
+		c.metadata = b
+	}
+}
+
+// WithMaxMessageDepth flattens the nested objects of records into
+// underscore separated metadata keys of up to depth levels, collapsing deeper
+// objects into JSON strings. Nested objects are not flattened by default.
+func WithMaxMessageDepth(depth int) Option {
+	return func(c *LokiClient) {
+		if depth > 0 {
+			c.maxDepth = depth
+		}
+	}
+}
+
+// WithMaxLineBytes drops the entries whose line is longer than n bytes,
+// unless WithSplitLongLines is enabled.
+func WithMaxLineBytes(n int) Option {
+	return func(c *LokiClient) {
+		if n > 0 {
+			c.maxLineBytes = n
+		}
+	}
+}
+
+// WithSplitLongLines splits the lines exceeding the max line bytes into
+// several entries sharing a split_id, each carrying its part index.
+func WithSplitLongLines(b bool) Option {
+	return func(c *LokiClient) {
+		c.splitLines = b
+	}
+}
+
+func WithDuplicateTimestamp(d DuplicateTimestamp) Option {
+	return func(c *LokiClient) {
+		c.duplicates = d
+	}
+}
+
+func WithInvalidUTF8(mode InvalidUTF8) Option {
+	return func(c *LokiClient) {
+		c.invalidUTF8 = mode
+	}
+}
+
+func WithBufferSize(size int) Option {
+	return func(c *LokiClient) {
+		if size > 0 {
+			c.buffer = make(chan lokiEntry, size)
+		}
+	}
+}
+
+// WithMaxBufferMemory caps the approximate number of bytes held by buffered
+// and not yet sent entries. Writers wait up to the write timeout for room
+// before the entry is dropped.
+func WithMaxBufferMemory(bytes int) Option {
+	return func(c *LokiClient) {
+		if bytes > 0 {
+			c.maxMemory = int64(bytes)
+		}
+	}
+}
+
+// WithMetricsNamespace publishes the client counters through expvar under the
+// given name, so that several clients of a process stay distinguishable.
+func WithMetricsNamespace(ns string) Option {
+	return func(c *LokiClient) {
+		c.namespace = ns
+	}
+}
+
+// WithDiagnosticsWriter redirects the client's own diagnostics (dropped logs,
+// failed batches) which are written to os.Stderr by default.
+func WithDiagnosticsWriter(w io.Writer) Option {
+	return func(c *LokiClient) {
+		if w != nil {
+			c.diagnostics = w
+		}
+	}
+}
+
+// WithOnClose registers a function run once by Close, after the buffered
+// logs have been drained. When the stop timeout or the StopContext context
+// expires first, it runs in the background once the aborted sends return.
+func WithOnClose(fn func()) Option {
+	return func(c *LokiClient) {
+		c.onClose = fn
+	}
+}
+
+// WithOnDrop registers a function called with a copy of each record dropped
+// because of a full buffer, the memory cap, the line length limit, a missing
+// required field or a duplicate timestamp, instead of reporting it to the
+// diagnostics. It runs in Write, or in the sending goroutine for duplicates,
+// and must not block.
+func WithOnDrop(fn func(entry []byte)) Option {
+	return func(c *LokiClient) {
+		c.onDrop = fn
+	}
+}
+
+// WithOnError routes the errors and events otherwise written to the
+// diagnostics writer, such as failed batches, to fn. It must not block.
+func WithOnError(fn func(err error)) Option {
+	return func(c *LokiClient) {
+		c.onError = fn
+	}
+}
+
+// WithDropReport makes the client ship, along with its next batch, an entry
+// counting the logs dropped since the previous report. It goes to a separate
+// stream labeled __meta__="dropped".
+func WithDropReport(b bool) Option {
+	return func(c *LokiClient) {
+		c.dropReport = b
+	}
+}
+
+// WithStopTimeout bounds the time Close waits for the buffered logs to be
+// sent. Once it expires, the pending sends are aborted and the logs lost.
+func WithStopTimeout(d time.Duration) Option {
+	return func(c *LokiClient) {
+		if d > 0 {
+			c.stopTimeout = d
+		}
+	}
+}
+
+// WithConnectionWarmup makes the client query the Loki readiness endpoint
+// before its first push, so that the connection is already established.
+func WithConnectionWarmup(b bool) Option {
+	return func(c *LokiClient) {
+		c.warmup = b
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Constructor
+// -----------------------------------------------------------------------------
+
+func NewLokiClient(host string, port int, opts ...Option) (*LokiClient, Close) {
+	c := &LokiClient{
+		endpoints:    nil,
+		endpoint:     atomic.Int32{},
+		useHTTPS:     false,
+		pathPrefix:   baseURL,
+		idempotency:  false,
+		username:     "",
+		password:     "",
+		bearer:       "",
+		tenant:       "",
+		userAgent:    "GoLokiClient",
+		httpClient:   http.DefaultClient,
+		tlsConfig:    nil,
+		proxy:        nil,
+		serializer:   JSONSerializer{},
+		contentType:  "",
+		gzipLevel:    0,
+		gzipBuf:      bytes.Buffer{},
+		gzipWriter:   nil,
+		labels:       make(map[string]string),
+		allowedKeys:  nil,
+		batchSize:    100,
+		maxBytes:     0,
+		adaptiveMin:  0,
+		adaptiveMax:  0,
+		writeTimeout: 100 * time.Millisecond,
+		queuePolicy:  QueueTimeout,
+		sendTimeout:  5 * time.Second,
+		respTimeout:  0,
+		maxRetryTime: 0,
+		backoff:      nil,
+		retries:      DefaultBackoff.Attempts - 1,
+		backoffBase:  0,
+		backoffMax:   0,
+		retryMaxAge:  0,
+		breaker:      nil,
+		retryQueue:   nil,
+		diskDir:      "",
+		diskMax:      0,
+		disk:         nil,
+		period:       15 * time.Second,
+		maxSkew:      0,
+		jitter:       0,
+		successCodes: []int{http.StatusOK, http.StatusNoContent},
+		emptyBody:    false,
+		responseHook: nil,
+		failedParser: nil,
+		capture:      nil,
+		tracer:       nil,
+		timeField:    slog.TimeKey,
+		timeLayout:   time.RFC3339Nano,
+		msgField:     slog.MessageKey,
+		lineFunc:     nil,
+		levelMapper:  nil,
+		enrichment:   nil,
+		required:     nil,
+		onViolation:  SchemaViolationMark,
+		jsonLine:     false,
+		rawLines:     false,
+		splitArrays:  false,
+		maxDepth:     0,
+		metadata:     true,
+		invalidUTF8:  InvalidUTF8Keep,
+		maxLineBytes: 0,
+		splitLines:   false,
+		duplicates:   DuplicateIncrement,
+		timestamps:   make(map[string]*streamTimestamps),
+		diagnostics:  os.Stderr,
+		onClose:      nil,
+		onDrop:       nil,
+		onError:      nil,
+		lastErr:      nil,
+		closeErr:     nil,
+		dropReport:   false,
+		lastDrops:    0,
+		stopTimeout:  0,
+		abort:        make(chan struct{}),
+		flushes:      make(chan chan error),
+		finished:     make(chan struct{}),
+		warmup:       false,
+		autoLabels:   nil,
+		maxStreams:   0,
+		buffer:       make(chan lokiEntry, 1000),
+		namespace:    "",
+		metrics:      lokiCounters{},
+		maxMemory:    0,
+		memory:       atomic.Int64{},
+		memoryFreed:  make(chan struct{}, 1),
+		wg:           sync.WaitGroup{},
+		once:         sync.Once{},
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+	if c.backoff == nil {
+		c.backoff = c.defaultBackoff()
+	}
+	c.endpoints = slices.DeleteFunc(c.endpoints, func(e string) bool {
+		if _, _, err := net.SplitHostPort(e); err != nil {
+			c.diagf("invalid endpoint %q, dropping it: %v\n", e, err)
+			return true
+		}
+		return false
+	})
+	c.endpoints = slices.Insert(c.endpoints, 0, fmt.Sprintf("%s:%d", host, port))
+	c.autoLabels = slices.DeleteFunc(c.autoLabels, func(k string) bool {
+		if !labelNameRegexp.MatchString(k) {
+			c.diagf("label %q is not a valid Loki label name, dropping it\n", k)
+			return true
+		}
+		if !c.labelAllowed(k) {
+			c.diagf("label %q is not allowed, dropping it\n", k)
+			return true
+		}
+		return false
+	})
+	for k := range c.labels {
+		if !labelNameRegexp.MatchString(k) {
+			c.diagf("label %q is not a valid Loki label name, dropping it\n", k)
+			delete(c.labels, k)
+			continue
+		}
+		if !c.labelAllowed(k) {
+			c.diagf("label %q is not allowed, dropping it\n", k)
+			delete(c.labels, k)
+		}
+	}
+
+	if (c.tlsConfig != nil || c.proxy != nil) && c.httpClient == http.DefaultClient {
+		transport := http.DefaultTransport.(*http.Transport).Clone() // nolint: forcetypeassert
+		if c.tlsConfig != nil {
+			transport.TLSClientConfig = c.tlsConfig
+		}
+		if c.proxy != nil {
+			transport.Proxy = c.proxy
+		}
+		c.httpClient = &http.Client{Transport: transport} // nolint: exhaustruct
+	}
+	if c.respTimeout > 0 {
+		c.httpClient = c.responseHeaderClient()
+	}
+	if c.diskDir != "" {
+		disk, err := newDiskBuffer(c.diskDir, c.diskMax)
+		if err != nil {
+			c.diagf("disk buffer disabled: %v\n", err)
+		}
+		c.disk = disk
+	}
+	if c.namespace != "" && !c.metrics.publish(c.namespace) {
+		c.diagf("metrics namespace %q is already registered\n", c.namespace)
+	}
+
+	c.wg.Add(1)
+	go c.run()
+
+	return c, c.stop
+}
+
+// NewLokiTestClient returns a client keeping the shipped entries in memory
+// instead of pushing them, for tests. It never touches the network, its Ping
+// always succeeding. The returned function stops the client,
+// flushing its buffer, and returns the [timestamp, line, metadata] tuples
+// shipped so far.
+func NewLokiTestClient(opts ...Option) (*LokiClient, func() [][]any) {
+	var mu sync.Mutex
+	var values [][]any
+	capture := func(c *LokiClient) {
+		c.capture = func(streams []LokiStream) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, stream := range streams {
+				for _, v := range stream.Values {
+					values = append(values, cloneValue(v))
+				}
+			}
+		}
+	}
+	c, stop := NewLokiClient("localhost", 0, append(opts, capture)...)
+
+	return c, func() [][]any {
+		stop()
+		mu.Lock()
+		defer mu.Unlock()
+
+		return slices.Clone(values)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Public
+// -----------------------------------------------------------------------------
+
+func (c *LokiClient) Write(input []byte) (int, error) {
+	return c.WriteContext(context.Background(), input)
+}
+
+// WriteContext is Write with a context, handed to the enrichment function.
+// Waiting for room in the buffer stops when the context is done, the entry
+// being dropped and the context error returned.
+func (c *LokiClient) WriteContext(ctx context.Context, input []byte) (int, error) {
+	defer func() {
+		recover() // nolint: errcheck
+	}()
+
+	var entries []lokiEntry
+	switch {
+	case c.rawLines:
+		entries = []lokiEntry{{
+			stream: nil,
+			value: []any{
+				strconv.FormatInt(time.Now().UnixNano(), 10),
+				string(sanitizeUTF8(input, c.invalidUTF8, `\x%02x`)),
+			},
+			raw: nil,
+		}}
+	case c.splitArrays && isJSONArray(input):
+		var err error
+		entries, err = c.parseArray(ctx, sanitizeUTF8(input, c.invalidUTF8, `\\x%02x`))
+		if err != nil {
+			c.dropSchemaViolation(input, err)
+			return 0, err
+		}
+	default:
+		entry, err := c.parseEntry(ctx, sanitizeUTF8(input, c.invalidUTF8, `\\x%02x`))
+		if err != nil {
+			c.dropSchemaViolation(input, err)
+			return 0, err
+		}
+		entries = []lokiEntry{entry}
+	}
+	var raw []byte
+	if c.onDrop != nil {
+		raw = slices.Clone(input)
+	}
+	for _, entry := range entries {
+		entry.raw = raw
+		for _, e := range c.limitLine(entry) {
+			if err := c.enqueue(ctx, e); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(input), nil
+}
+
+// Flush sends the buffered entries right away, and waits until they are sent
+// or ctx is done. It returns the error of the send, if any.
+func (c *LokiClient) Flush(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case c.flushes <- done:
+	case <-c.finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ping queries the Loki readiness endpoint, with the client scheme, endpoint
+// and credentials, and returns nil when Loki is ready.
+func (c *LokiClient) Ping(ctx context.Context) error {
+	return c.ready(ctx)
+}
+
+// CloseE stops the client like the Close returned by NewLokiClient, and
+// returns the error of the final flush, if any.
+func (c *LokiClient) CloseE() error {
+	c.stop()
+
+	return c.closeErr
+}
+
+// StopContext stops the client like CloseE, but abandons the final flush and
+// returns the context error if ctx is done first.
+func (c *LokiClient) StopContext(ctx context.Context) error {
+	c.shutdown(ctx)
+
+	return c.closeErr
+}
+
+// ----------------------------------------------------------------------------
+// Unexported functions
+// ----------------------------------------------------------------------------
+
+// parseEntry turns a JSON record into a Loki entry.
+func (c *LokiClient) parseEntry(ctx context.Context, input []byte) (lokiEntry, error) {
+	values := newMetadata()
+
+	err := json.Unmarshal(input, &values)
+	if err != nil {
+		return lokiEntry{}, err
+	}
+
+	return c.valuesEntry(ctx, values)
+}
+
+// parseArray turns a JSON array of records into Loki entries. Either all the
+// records are valid, or none is returned.
+func (c *LokiClient) parseArray(ctx context.Context, input []byte) ([]lokiEntry, error) {
+	var records []map[string]any
+
+	err := json.Unmarshal(input, &records)
+	if err != nil {
+		return nil, err
+	}
+	// In UTC, which the layouts without a zone are parsed in.
+	now := time.Now().UTC().Format(c.timeLayout)
+	entries := make([]lokiEntry, 0, len(records))
+	for _, values := range records {
+		if _, ok := values[c.timeField]; !ok {
+			values[c.timeField] = now
+		}
+		entry, err := c.valuesEntry(ctx, values)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// valuesEntry turns the decoded fields of a record into a Loki entry.
+func (c *LokiClient) valuesEntry(ctx context.Context, values map[string]any) (lokiEntry, error) {
+	var err error
+
+	datetime, ok := values[c.timeField]
+	if !ok {
+		return lokiEntry{}, fmt.Errorf("missing %s parameter", c.timeField)
+	}
+	datetimeStr, ok := datetime.(string)
+	if !ok {
+		return lokiEntry{}, fmt.Errorf("wrong %s format", c.timeField)
+	}
+	// RFC3339Nano, the default layout, parses any second fraction.
+	d, err := time.Parse(c.timeLayout, datetimeStr)
+	if err != nil {
+		return lokiEntry{}, err
+	}
+	if c.maxSkew > 0 {
+		now := time.Now()
+		if earliest := now.Add(-c.maxSkew); d.Before(earliest) {
+			d = earliest
+		} else if latest := now.Add(c.maxSkew); d.After(latest) {
+			d = latest
+		}
+	}
+	msg, ok := values[c.msgField]
+	if !ok {
+		return lokiEntry{}, fmt.Errorf("missing %s parameter", c.msgField)
+	}
+	msgStr, ok := msg.(string)
+	if !ok {
+		return lokiEntry{}, fmt.Errorf("wrong %s format", c.msgField)
+	}
+	if n, ok := values["level"].(float64); ok && c.levelMapper != nil {
+		values["level"] = levelName(c.levelMapper(n))
+	}
+	if c.enrichment != nil {
+		c.enrichment(ctx, values)
+	}
+	if missing := c.missingFields(values); len(missing) > 0 {
+		c.metrics.schemaViolations.Add(1)
+		if c.onViolation == SchemaViolationDrop {
+			c.metrics.dropped.Add(1)
+			return lokiEntry{}, fmt.Errorf("%w: %s", ErrSchemaViolation, strings.Join(missing, ","))
+		}
+		values["__schema_violation__"] = strings.Join(missing, ",")
+	}
+	line := msgStr
+	switch {
+	case c.lineFunc != nil:
+		line = c.lineFunc(values)
+	case c.jsonLine:
+		line, err = orderedJSON(values)
+		if err != nil {
+			return lokiEntry{}, err
+		}
+	}
+
+	var stream map[string]string
+	for _, k := range c.autoLabels {
+		v, ok := values[k]
+		if !ok {
+			continue
+		}
+		if stream == nil {
+			stream = make(map[string]string, len(c.autoLabels))
+		}
+		stream[k] = fieldString(v)
+		delete(values, k)
+	}
+
+	delete(values, c.timeField)
+	delete(values, c.msgField)
+	delete(values, "service")
+
+	if c.maxDepth > 0 {
+		for k, v := range values {
+			if _, ok := v.(map[string]any); ok {
+				delete(values, k)
+				flatten(values, k, v, c.maxDepth)
+			}
+		}
+	}
+	for k, v := range values {
+		if _, ok := v.(string); !ok {
+			values[k] = fieldString(v)
+		}
+	}
+
+	ts := strconv.FormatInt(d.UnixNano(), 10)
+	if !c.metadata {
+		releaseMetadata(values)
+		return lokiEntry{
+			stream: stream,
+			value:  newTuple(ts, line, nil)[:2],
+			raw:    nil,
+		}, nil
+	}
+
+	return lokiEntry{
+		stream: stream,
+		value:  newTuple(ts, line, values),
+		raw:    nil,
+	}, nil
+}
+
+// fieldString formats a decoded field value, objects and arrays being
+// encoded as JSON so that they remain parseable.
+func fieldString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		if err == nil {
+			return string(b)
+		}
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// flatten stores value into dst under key, the nested objects being flattened
+// into underscore separated keys of up to depth levels. Deeper objects are
+// collapsed into a JSON string.
+func flatten(dst map[string]any, key string, value any, depth int) {
+	object, ok := value.(map[string]any)
+	if !ok {
+		dst[key] = value
+		return
+	}
+	if depth <= 1 {
+		dst[key] = fieldString(object)
+		return
+	}
+	for k, v := range object {
+		flatten(dst, key+"_"+k, v, depth-1)
+	}
+}
+
+// isJSONArray tells whether input starts with a JSON array.
+func isJSONArray(input []byte) bool {
+	trimmed := bytes.TrimLeft(input, " \t\r\n")
+
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// missingFields returns the required fields absent from values.
+func (c *LokiClient) missingFields(values map[string]any) []string {
+	var missing []string
+	for _, k := range c.required {
+		if _, ok := values[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+
+	return missing
+}
+
+// limitLine enforces the max line bytes, either by dropping the entry or
+// by splitting its line into several entries.
+func (c *LokiClient) limitLine(entry lokiEntry) []lokiEntry {
+	line, _ := entry.value[1].(string)
+	if c.maxLineBytes <= 0 || len(line) <= c.maxLineBytes {
+		return []lokiEntry{entry}
+	}
+	if !c.splitLines {
+		c.drop(entry, "line exceeds %d bytes, dropping log\n", c.maxLineBytes)
+		return nil
+	}
+
+	var chunks []string
+	for len(line) > c.maxLineBytes {
+		cut := c.maxLineBytes
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = c.maxLineBytes
+		}
+		chunks = append(chunks, line[:cut])
+		line = line[cut:]
+	}
+	chunks = append(chunks, line)
+
+	id := newUUID()
+	entries := make([]lokiEntry, 0, len(chunks))
+	for i, chunk := range chunks {
+		metadata := map[string]any{}
+		if len(entry.value) > 2 {
+			if values, ok := entry.value[2].(map[string]any); ok {
+				maps.Copy(metadata, values)
+			}
+		}
+		metadata["split_id"] = id
+		metadata["part"] = strconv.Itoa(i + 1)
+		metadata["parts"] = strconv.Itoa(len(chunks))
+		value := []any{entry.value[0], chunk, metadata}
+		if !c.metadata {
+			value = value[:2]
+		}
+		entries = append(entries, lokiEntry{
+			stream: entry.stream,
+			value:  value,
+			raw:    entry.raw,
+		})
+	}
+	releaseValue(entry.value)
+
+	return entries
+}
+
+// enqueue pushes an entry to the buffer, dropping it when there is no room
+// left before the write timeout.
+func (c *LokiClient) enqueue(ctx context.Context, entry lokiEntry) error {
+	size := entrySize(entry)
+
+	var timeout <-chan time.Time
+	switch c.queuePolicy {
+	case QueueDropNewest, QueueDropOldest:
+		timeout = expired
+	case QueueBlock:
+	default:
+		timer := time.NewTimer(c.writeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	if !c.reserveMemory(ctx, size, timeout) {
+		if err := ctx.Err(); err != nil {
+			c.drop(entry, "")
+			return err
+		}
+		if !c.spill(entry) {
+			c.drop(entry, "buffer memory limit reached, dropping log\n")
+		}
+		return nil
+	}
+	if c.queuePolicy == QueueDropOldest {
+		c.enqueueEvicting(entry)
+		return nil
+	}
+	// Try first without waiting, as select would pick the expired timeout
+	// at random over a buffer with room.
+	select {
+	case c.buffer <- entry:
+		c.metrics.accepted.Add(1)
+		return nil
+	default:
+	}
+	select {
+	case c.buffer <- entry:
+		c.metrics.accepted.Add(1)
+	case <-timeout:
+		c.releaseMemory(size)
+		if !c.spill(entry) {
+			c.metrics.bufferFull.Add(1)
+			c.drop(entry, "buffer is full, dropping log\n")
+		}
+	case <-ctx.Done():
+		c.releaseMemory(size)
+		c.drop(entry, "")
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// spill writes an entry to the disk buffer, if any, reporting whether it
+// was.
+func (c *LokiClient) spill(entry lokiEntry) bool {
+	if c.disk == nil {
+		return false
+	}
+	if err := c.disk.append([]lokiEntry{entry}, ""); err != nil {
+		c.diagf("failed to spill log to disk: %v\n", err)
+		return false
+	}
+	c.metrics.accepted.Add(1)
+
+	return true
+}
+
+// enqueueEvicting pushes an entry to the buffer, evicting the oldest
+// buffered entries until there is room for it.
+func (c *LokiClient) enqueueEvicting(entry lokiEntry) {
+	for {
+		select {
+		case c.buffer <- entry:
+			c.metrics.accepted.Add(1)
+			return
+		default:
+		}
+		select {
+		case old := <-c.buffer:
+			c.releaseMemory(entrySize(old))
+			c.metrics.bufferFull.Add(1)
+			c.drop(old, "buffer is full, dropping oldest log\n")
+		default:
+		}
+	}
+}
+
+// drop counts a dropped entry and hands its record to the drop callback, or
+// reports it to the diagnostics when there is no callback and format is set.
+func (c *LokiClient) drop(entry lokiEntry, format string, args ...any) {
+	c.metrics.dropped.Add(1)
+	switch {
+	case c.onDrop != nil:
+		c.onDrop(entry.raw)
+	case format != "":
+		c.diagf(format, args...)
+	}
+}
+
+// dropSchemaViolation hands a record dropped for a missing required field to
+// the drop callback.
+func (c *LokiClient) dropSchemaViolation(input []byte, err error) {
+	if c.onDrop != nil && errors.Is(err, ErrSchemaViolation) {
+		c.onDrop(slices.Clone(input))
+	}
+}
+
+func (c *LokiClient) stop() {
+	c.shutdown(context.Background())
+}
+
+// shutdown closes the buffer and waits for the run loop to send it, until
+// ctx is done or the stop timeout expires.
+func (c *LokiClient) shutdown(ctx context.Context) {
+	c.once.Do(func() {
+		close(c.buffer)
+		c.closeErr = c.wait(ctx)
+		if c.onClose == nil {
+			return
+		}
+		select {
+		case <-c.finished:
+			c.onClose()
+		default:
+			// The run loop is still returning from the aborted sends.
+			go func() {
+				<-c.finished
+				c.onClose()
+			}()
+		}
+	})
+}
+
+// wait waits for the run goroutine to drain the buffer, and returns the error
+// of its final flush. When a stop timeout is set and expires first, the
+// pending sends are aborted.
+func (c *LokiClient) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if c.stopTimeout > 0 {
+		timer := time.NewTimer(c.stopTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-done:
+		return c.lastErr
+	case <-timeout:
+		close(c.abort)
+		c.diagf("stop timed out after %s, abandoning pending logs\n", c.stopTimeout)
+		return ErrStopTimeout
+	case <-ctx.Done():
+		close(c.abort)
+		c.diagf("stop canceled (%v), abandoning pending logs\n", ctx.Err())
+		return ctx.Err()
+	}
+}
+
+func (c *LokiClient) run() {
+	defer c.wg.Done()
+	defer close(c.finished)
+
+	if c.warmup {
+		if err := c.ready(context.Background()); err != nil {
+			c.diagf("connection warmup failed: %v\n", err)
+		}
+	}
+
+	c.drainDisk()
+
+	waitCheck := time.NewTimer(c.nextPeriod())
+	defer waitCheck.Stop()
+	batch := []lokiEntry{}
+	batchSize := c.batchSize
+	if c.adaptiveMax > 0 {
+		batchSize = max(c.adaptiveMin, min(batchSize, c.adaptiveMax))
+	}
+	streams := make(map[string]struct{})
+	var batchBytes int64
+	flush := func() error {
+		start := time.Now()
+		err := c.flush(batch)
+		if c.adaptiveMax > 0 {
+			batchSize = c.adaptBatchSize(batchSize, len(batch), time.Since(start), err)
+		}
+		batch = batch[:0]
+		clear(streams)
+		batchBytes = 0
+
+		return err
+	}
+	add := func(e lokiEntry) {
+		if !c.resolveDuplicate(e) {
+			return
+		}
+		if c.maxStreams > 0 {
+			key := streamKey(e.stream)
+			if _, ok := streams[key]; !ok {
+				if len(streams) >= c.maxStreams {
+					flush() // nolint: errcheck
+				}
+				streams[key] = struct{}{}
+			}
+		}
+		if c.maxBytes > 0 {
+			size := entrySize(e)
+			if len(batch) > 0 && batchBytes+size > c.maxBytes {
+				flush() // nolint: errcheck
+			}
+			batchBytes += size
+		}
+		batch = append(batch, e)
+		if len(batch) >= batchSize {
+			flush() // nolint: errcheck
+		}
+	}
+	for {
+		select {
+		case e, ok := <-c.buffer:
+			if !ok {
+				c.lastErr = flush()
+				c.resendQueued()
+				return
+			}
+			add(e)
+
+		case done := <-c.flushes:
+			// Take what is buffered at the time of the request.
+			for range len(c.buffer) {
+				e, ok := <-c.buffer
+				if !ok {
+					break
+				}
+				add(e)
+			}
+			done <- flush()
+
+		case <-waitCheck.C:
+			flush() // nolint: errcheck
+			c.resendQueued()
+			c.drainDisk()
+			waitCheck.Reset(c.nextPeriod())
+		}
+	}
+}
+
+// nextPeriod returns the delay until the next periodic flush, randomized by
+// the batch jitter.
+func (c *LokiClient) nextPeriod() time.Duration {
+	if c.jitter <= 0 {
+		return c.period
+	}
+	offset := (rand.Float64()*2 - 1) * c.jitter // nolint: gosec
+
+	return c.period + time.Duration(offset*float64(c.period))
+}
+
+// resolveDuplicate applies the duplicate timestamp strategy to an entry
+// read from the buffer, and counts the entries older than the previous one of
+// their stream. It returns false when the entry is dropped.
+func (c *LokiClient) resolveDuplicate(entry lokiEntry) bool {
+	tsStr, _ := entry.value[0].(string)
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return true
+	}
+	key := streamKey(entry.stream)
+	last, ok := c.timestamps[key]
+	if !ok {
+		if len(c.timestamps) >= maxTrackedStreams {
+			clear(c.timestamps)
+		}
+		last = &streamTimestamps{original: 0, sent: 0}
+		c.timestamps[key] = last
+	}
+	if ts < last.original {
+		c.metrics.outOfOrder.Add(1)
+	}
+	// An increment also makes the entries up to the last nudged timestamp
+	// collide, so that a later entry is not sent with it too.
+	collides := ts == last.original ||
+		(c.duplicates == DuplicateIncrement && ts > last.original && ts <= last.sent)
+	if !collides || c.duplicates == DuplicateKeep {
+		last.original = ts
+		last.sent = ts
+		return true
+	}
+	switch c.duplicates {
+	case DuplicateDrop:
+		c.releaseMemory(entrySize(entry))
+		c.drop(entry, "")
+		return false
+	default:
+		last.original = ts
+		last.sent++
+		entry.value[0] = strconv.FormatInt(last.sent, 10)
+		return true
+	}
+}
+
+// adaptBatchSize halves the batch size after a failed or slow send and
+// doubles it after a fast one, within the adaptive bounds.
+func (c *LokiClient) adaptBatchSize(size, sent int, elapsed time.Duration, err error) int {
+	if sent == 0 {
+		return size
+	}
+	if err != nil || elapsed > c.sendTimeout/10 {
+		return max(c.adaptiveMin, size/2)
+	}
+
+	return min(c.adaptiveMax, size*2)
+}
+
+func (c *LokiClient) labelAllowed(key string) bool {
+	if c.allowedKeys == nil {
+		return true
+	}
+	_, ok := c.allowedKeys[key]
+
+	return ok
+}
+
+func (c *LokiClient) diagf(format string, args ...any) {
+	if c.onError != nil {
+		c.onError(fmt.Errorf(strings.TrimSuffix(format, "\n"), args...)) // nolint: err113
+		return
+	}
+	fmt.Fprintf(c.diagnostics, "[LokiClient] "+format, args...)
+}
+
+func (c *LokiClient) flush(batch []lokiEntry) error {
+	err := c.sendBatch(c.streams(batch))
+	if c.maxMemory > 0 {
+		var size int64
+		for _, e := range batch {
+			size += entrySize(e)
+		}
+		c.releaseMemory(size)
+	}
+	if err == nil {
+		for _, e := range batch {
+			releaseValue(e.value)
+		}
+	}
+
+	return err
+}
+
+func (c *LokiClient) reserveMemory(ctx context.Context, size int64, timeout <-chan time.Time) bool {
+	if c.maxMemory <= 0 {
+		return true
+	}
+	if size > c.maxMemory {
+		return false
+	}
+	for {
+		current := c.memory.Load()
+		if current+size <= c.maxMemory {
+			if c.memory.CompareAndSwap(current, current+size) {
+				return true
+			}
+			continue
+		}
+		// Take a pending release first, as select would pick an expired
+		// timeout at random over it.
+		select {
+		case <-c.memoryFreed:
+			continue
+		default:
+		}
+		select {
+		case <-c.memoryFreed:
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (c *LokiClient) releaseMemory(size int64) {
+	if c.maxMemory <= 0 || size == 0 {
+		return
+	}
+	c.memory.Add(-size)
+	select {
+	case c.memoryFreed <- struct{}{}:
+	default:
+	}
+}
+
+// orderedJSON encodes the fields with the builtin keys first, then the other
+// keys in sorted order.
+func orderedJSON(values map[string]any) (string, error) {
+	builtins := []string{"time", "level", "msg"}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		if !slices.Contains(builtins, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, k := range append(builtins, keys...) {
+		v, ok := values[k]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return "", err
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	return buf.String(), nil
+}
+
+// entrySize returns an approximation of the memory held by a buffered entry.
+func entrySize(entry lokiEntry) int64 {
+	size := entryOverhead
+	for k, v := range entry.stream {
+		size += len(k) + len(v) + entryOverhead
+	}
+	for _, v := range entry.value {
+		switch v := v.(type) {
+		case string:
+			size += len(v)
+		case map[string]any:
+			for k, val := range v {
+				size += len(k) + entryOverhead
+				if str, ok := val.(string); ok {
+					size += len(str)
+				}
+			}
+		}
+	}
+
+	return int64(size)
+}
+
+// streams groups the batch entries into the streams of a push request,
+// in the order the streams first appear in the batch.
+func (c *LokiClient) streams(batch []lokiEntry) []LokiStream {
+	var streams []LokiStream
+	index := make(map[string]int)
+	for _, e := range batch {
+		key := streamKey(e.stream)
+		i, ok := index[key]
+		if !ok {
+			labels := c.labels
+			if e.stream != nil {
+				labels = maps.Clone(c.labels)
+				maps.Copy(labels, e.stream)
+			}
+			i = len(streams)
+			index[key] = i
+			streams = append(streams, LokiStream{
+				Stream: labels,
+				Values: nil,
+			})
+		}
+		streams[i].Values = append(streams[i].Values, e.value)
+	}
+	for _, stream := range streams {
+		slices.SortStableFunc(stream.Values, func(a, b []any) int {
+			return cmp.Compare(valueTime(a), valueTime(b))
+		})
+	}
+	if c.dropReport {
+		if n := c.metrics.dropped.Load() - c.lastDrops; n > 0 {
+			c.lastDrops += n
+			labels := maps.Clone(c.labels)
+			labels["__meta__"] = "dropped"
+			value := []any{
+				strconv.FormatInt(time.Now().UnixNano(), 10),
+				fmt.Sprintf("%d logs dropped", n),
+				map[string]any{"dropped": strconv.FormatInt(n, 10)},
+			}
+			if !c.metadata {
+				value = value[:2]
+			}
+			streams = append(streams, LokiStream{
+				Stream: labels,
+				Values: [][]any{value},
+			})
+		}
+	}
+
+	return streams
+}
+
+func (c *LokiClient) sendBatch(streams []LokiStream) error {
+	var err error
+
+	if len(streams) == 0 {
+		return nil
+	}
+	key := ""
+	if c.idempotency {
+		key = newUUID()
+	}
+	ctx, cancel := c.abortContext()
 	defer cancel()
 
-	buf, err := json.Marshal(&lokiRequest{
-		Streams: []lokiStream{{
-			Stream: c.labels,
-			Values: batch,
-		}},
+	start := time.Now()
+	failovers := 0
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		attemptCtx, cancelAttempt := c.attemptContext(ctx, start)
+		resp, err = c.guardedSend(attemptCtx, streams, key, attempt)
+		cancelAttempt()
+		if err == nil {
+			c.metrics.batchesSent.Add(1)
+			return nil
+		}
+		if errors.Is(err, ErrCircuitOpen) {
+			break
+		}
+		var partial *partialFailure
+		if errors.As(err, &partial) {
+			streams = partial.retain(streams)
+			// The retry carries another payload, which must not be taken
+			// for a replay of this one.
+			if key != "" {
+				key = newUUID()
+			}
+		}
+		sleep, retry := c.backoff.NextDelay(attempt, resp, err)
+		if retry && c.maxRetryTime > 0 && time.Since(start)+sleep >= c.maxRetryTime {
+			retry = false
+		}
+		if !retry {
+			// The max retry duration covers all the endpoints.
+			spent := c.maxRetryTime > 0 && time.Since(start) >= c.maxRetryTime
+			if failovers >= len(c.endpoints)-1 || ctx.Err() != nil || spent {
+				break
+			}
+			failovers++
+			c.failover(err)
+			attempt = -1
+			continue
+		}
+		if !sleepContext(ctx, sleep) {
+			break
+		}
+	}
+	if err != nil {
+		if c.retryMaxAge > 0 && ctx.Err() == nil {
+			c.queueFailed(streams, key)
+			c.diagf("failed to send batch, queued for a later retry: %v\n", err)
+			return err
+		}
+		if c.disk != nil {
+			if spillErr := c.disk.append(streamEntries(streams), key); spillErr == nil {
+				c.diagf("failed to send batch, spilled to disk: %v\n", err)
+				return err
+			}
+		}
+		c.metrics.batchesFailed.Add(1)
+		c.diagf("failed to send batch: %v\n", err)
+	}
+
+	return err
+}
+
+// guardedSend sends the streams unless the circuit breaker is open, and
+// records the outcome unless a stop aborted the send.
+func (c *LokiClient) guardedSend(ctx context.Context, streams []LokiStream, key string, attempt int) (*http.Response, error) {
+	if c.breaker == nil {
+		return c.send(ctx, streams, key, attempt)
+	}
+	if !c.breaker.allow(time.Now()) {
+		return nil, ErrCircuitOpen
+	}
+	resp, err := c.send(ctx, streams, key, attempt)
+	select {
+	case <-c.abort:
+	default:
+		c.breaker.record(time.Now(), err)
+	}
+
+	return resp, err
+}
+
+// attemptContext bounds an attempt of a batch started at start by what is
+// left of the max retry duration, the send timeout applying below it.
+func (c *LokiClient) attemptContext(ctx context.Context, start time.Time) (context.Context, context.CancelFunc) {
+	if c.maxRetryTime <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithDeadline(ctx, start.Add(c.maxRetryTime))
+}
+
+// abortContext returns a context canceled when a stop times out.
+func (c *LokiClient) abortContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// queueFailed keeps a copy of a failed batch, with its idempotency key, for
+// resendQueued.
+func (c *LokiClient) queueFailed(streams []LokiStream, key string) {
+	queued := make([]LokiStream, 0, len(streams))
+	for _, stream := range streams {
+		queued = append(queued, LokiStream{
+			Stream: stream.Stream,
+			Values: slices.Clone(stream.Values),
+		})
+	}
+	if len(c.retryQueue) >= maxRetryQueue {
+		c.metrics.batchesFailed.Add(1)
+		c.diagf("retry queue is full, giving up on a batch failed at %s\n", c.retryQueue[0].failedAt.Format(time.RFC3339))
+		c.retryQueue = slices.Delete(c.retryQueue, 0, 1)
+	}
+	c.retryQueue = append(c.retryQueue, failedBatch{
+		streams:  queued,
+		key:      key,
+		failedAt: time.Now(),
 	})
+}
+
+// resendQueued makes a single attempt at sending the queued batches, oldest
+// first, stopping at the first failure, and gives up on those older than the
+// retry queue max age.
+func (c *LokiClient) resendQueued() {
+	if len(c.retryQueue) == 0 {
+		return
+	}
+	ctx, cancel := c.abortContext()
+	defer cancel()
+
+	pending := c.retryQueue[:0]
+	failed := false
+	for _, b := range c.retryQueue {
+		if !failed && ctx.Err() == nil {
+			if _, err := c.guardedSend(ctx, b.streams, b.key, 0); err == nil {
+				c.metrics.batchesSent.Add(1)
+				continue
+			}
+			failed = true
+		}
+		if time.Since(b.failedAt) > c.retryMaxAge || ctx.Err() != nil {
+			c.metrics.batchesFailed.Add(1)
+			c.diagf("giving up on a queued batch failed at %s\n", b.failedAt.Format(time.RFC3339))
+			continue
+		}
+		pending = append(pending, b)
+	}
+	clear(c.retryQueue[len(pending):])
+	c.retryQueue = pending
+}
+
+// drainDisk sends the entries of the disk buffer by batches, keeping on disk
+// those from the first batch which fails.
+func (c *LokiClient) drainDisk() {
+	if c.disk == nil {
+		return
+	}
+	entries, err := c.disk.take()
 	if err != nil {
-		return err
+		c.diagf("failed to read disk buffer: %v\n", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	ctx, cancel := c.abortContext()
+	defer cancel()
+
+	for len(entries) > 0 && ctx.Err() == nil {
+		chunk := entries[:diskBatch(entries, c.batchSize)]
+		if _, err := c.guardedSend(ctx, c.streams(lokiEntries(chunk)), chunk[0].Key, 0); err != nil {
+			break
+		}
+		c.metrics.batchesSent.Add(1)
+		entries = entries[len(chunk):]
+	}
+	if err := c.disk.done(entries); err != nil {
+		c.diagf("failed to update disk buffer: %v\n", err)
+	}
+}
+
+// streamEntries turns streams back into entries.
+func streamEntries(streams []LokiStream) []lokiEntry {
+	var entries []lokiEntry
+	for _, stream := range streams {
+		for _, value := range stream.Values {
+			entries = append(entries, lokiEntry{stream: stream.Stream, value: value, raw: nil})
+		}
+	}
+
+	return entries
+}
+
+// defaultBackoff returns the backoff set by WithRetries and
+// WithBackoffBounds.
+func (c *LokiClient) defaultBackoff() Backoff {
+	if c.backoffBase > 0 {
+		return ExponentialBackoff{
+			Retries: c.retries,
+			Base:    c.backoffBase,
+			Max:     c.backoffMax,
+			Jitter:  DefaultBackoff.Jitter,
+		}
+	}
+	b := DefaultBackoff
+	b.Attempts = c.retries + 1
+
+	return b
+}
+
+// responseHeaderClient returns a copy of the HTTP client whose transport has
+// the response header timeout.
+func (c *LokiClient) responseHeaderClient() *http.Client {
+	rt := c.httpClient.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	transport, ok := rt.(*http.Transport)
+	if !ok {
+		c.diagf("cannot set the response header timeout of a %T transport\n", rt)
+		return c.httpClient
 	}
+	transport = transport.Clone()
+	transport.ResponseHeaderTimeout = c.respTimeout
+	client := *c.httpClient
+	client.Transport = transport
+
+	return &client
+}
+
+func (c *LokiClient) url(path string) string {
 	scheme := "http"
 	if c.useHTTPS {
 		scheme = "https"
 	}
-	url := fmt.Sprintf("%s://%s:%d/%s/push", scheme, c.host, c.port, baseURL)
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(buf))
-	if err != nil {
-		return err
-	}
+
+	return fmt.Sprintf("%s://%s/%s", scheme, c.endpoints[c.endpoint.Load()], path)
+}
+
+// failover switches to the next endpoint after the current one failed.
+func (c *LokiClient) failover(err error) {
+	next := (int(c.endpoint.Load()) + 1) % len(c.endpoints)
+	c.endpoint.Store(int32(next)) // nolint: gosec
+	c.diagf("endpoint failing (%v), switching to %s\n", err, c.endpoints[next])
+}
+
+func (c *LokiClient) authorize(req *http.Request) {
 	if c.username != "" && c.password != "" {
 		req.SetBasicAuth(c.username, c.password)
 	}
 	if c.bearer != "" {
 		req.Header.Set("Authorization", "Bearer "+c.bearer)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "GoLokiClient")
+	if c.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", c.tenant)
+	}
+}
+
+// ready queries the Loki readiness endpoint.
+func (c *LokiClient) ready(ctx context.Context) error {
+	if c.capture != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.sendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("ready"), http.NoBody)
+	if err != nil {
+		return err
+	}
+	c.authorize(req)
+	req.Header.Set("User-Agent", c.userAgent)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -313,11 +2284,287 @@ func (c *LokiClient) send(ctx context.Context, batch [][]any) error {
 	}
 
 	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		// empty response buffer
-		io.ReadAll(io.LimitReader(resp.Body, 2048)) // nolint:errcheck
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 2048)) // nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("server returned status %s (%d)", resp.Status, resp.StatusCode)
 	}
 
 	return nil
 }
+
+func (c *LokiClient) send(ctx context.Context, streams []LokiStream, key string, attempt int) (*http.Response, error) {
+	if c.capture != nil {
+		c.capture(streams)
+		return nil, nil // nolint: nilnil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.sendTimeout)
+	defer cancel()
+
+	buf, contentType, err := c.serializer.Marshal(streams)
+	if err != nil {
+		return nil, err
+	}
+	if c.gzipLevel != 0 {
+		buf, err = c.compress(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.tracer != nil {
+		var span trace.Span
+		ctx, span = c.tracer.Start(ctx, "loki.push", trace.WithSpanKind(trace.SpanKindClient))
+		defer span.End()
+		resp, err := c.post(ctx, streams, buf, contentType, key)
+		traceSend(span, streams, len(buf), attempt, resp, err)
+
+		return resp, err
+	}
+
+	return c.post(ctx, streams, buf, contentType, key)
+}
+
+// post pushes a serialized batch.
+func (c *LokiClient) post(ctx context.Context, streams []LokiStream, buf []byte, contentType, key string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url(path.Join(c.pathPrefix, "push")), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	if key != "" {
+		req.Header.Set(idempotencyHeader, key)
+	}
+	if c.contentType != "" {
+		contentType = c.contentType
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.gzipLevel != 0 {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if c.responseHook != nil {
+		body := resp.Body
+		resp.Body = io.NopCloser(io.LimitReader(body, maxResponseHookBytes))
+		c.responseHook(resp)
+		resp.Body = body
+	}
+	if !slices.Contains(c.successCodes, resp.StatusCode) {
+		// empty response buffer
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		err = fmt.Errorf("server returned status %s (%d)", resp.Status, resp.StatusCode)
+		if failed := c.failedStreams(body, len(streams)); len(failed) > 0 {
+			return resp, &partialFailure{streams: failed, err: err}
+		}
+		return resp, err
+	}
+	if c.emptyBody {
+		if n, _ := io.ReadFull(resp.Body, make([]byte, 1)); n > 0 {
+			return resp, fmt.Errorf("server returned status %s (%d) with an unexpected body", resp.Status, resp.StatusCode)
+		}
+	}
+	c.metrics.bytesSent.Add(int64(len(buf)))
+
+	return resp, nil
+}
+
+// compress gzips a serialized batch into a buffer reused by the next sends.
+func (c *LokiClient) compress(buf []byte) ([]byte, error) {
+	c.gzipBuf.Reset()
+	if c.gzipWriter == nil {
+		w, err := gzip.NewWriterLevel(&c.gzipBuf, c.gzipLevel)
+		if err != nil {
+			return nil, err
+		}
+		c.gzipWriter = w
+	} else {
+		c.gzipWriter.Reset(&c.gzipBuf)
+	}
+	if _, err := c.gzipWriter.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := c.gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return c.gzipBuf.Bytes(), nil
+}
+
+// traceSend records the outcome of a push attempt on its span.
+func traceSend(span trace.Span, streams []LokiStream, size, attempt int, resp *http.Response, err error) {
+	entries := 0
+	for _, stream := range streams {
+		entries += len(stream.Values)
+	}
+	span.SetAttributes(
+		attribute.Int("loki.batch.streams", len(streams)),
+		attribute.Int("loki.batch.entries", entries),
+		attribute.Int("loki.batch.bytes", size),
+		attribute.Int("loki.attempt", attempt),
+	)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// lokiEntry is a buffered log entry.
+type lokiEntry struct {
+	// stream holds the labels of the entry added to the static ones, if any.
+	stream map[string]string
+	// value is the [timestamp, line] or [timestamp, line, metadata] tuple.
+	value []any
+	// raw is a copy of the written record, kept for the drop callback only.
+	raw []byte
+}
+
+// streamTimestamps tracks the last timestamp of a stream, as written and as
+// sent, to detect duplicates.
+type streamTimestamps struct {
+	original int64
+	sent     int64
+}
+
+// streamKey returns a string identifying a set of labels.
+func streamKey(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := slices.Sorted(maps.Keys(labels))
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+		b.WriteByte(',')
+	}
+
+	return b.String()
+}
+
+// valueTime returns the timestamp of a value tuple, in nanoseconds.
+func valueTime(value []any) int64 {
+	tsStr, _ := value[0].(string)
+	ts, _ := strconv.ParseInt(tsStr, 10, 64)
+
+	return ts
+}
+
+// failedBatch is a batch waiting in the retry queue.
+type failedBatch struct {
+	streams  []LokiStream
+	key      string
+	failedAt time.Time
+}
+
+// partialFailure is returned by send when the server reports which streams
+// of the request failed, so that only those are retried.
+type partialFailure struct {
+	streams []int
+	err     error
+}
+
+func (e *partialFailure) Error() string {
+	return fmt.Sprintf("%v (%d streams failed)", e.err, len(e.streams))
+}
+
+func (e *partialFailure) Unwrap() error {
+	return e.err
+}
+
+func (e *partialFailure) retain(streams []LokiStream) []LokiStream {
+	failed := make([]LokiStream, 0, len(e.streams))
+	for _, i := range e.streams {
+		failed = append(failed, streams[i])
+	}
+
+	return failed
+}
+
+// ParseFailedStreams parses a failed push response body of the form
+// {"failed_streams":[0,2]}, listing the indices of the failed streams, for
+// WithFailedStreams. This is a contract of custom gateways, not of Loki.
+func ParseFailedStreams(body []byte, _ int) []int {
+	var resp struct {
+		FailedStreams []int `json:"failed_streams"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+
+	return resp.FailedStreams
+}
+
+// failedStreams returns the indices of the failed streams found by the
+// WithFailedStreams parser, or nil when it does not find valid ones.
+func (c *LokiClient) failedStreams(body []byte, count int) []int {
+	if c.failedParser == nil {
+		return nil
+	}
+	failed := slices.Clone(c.failedParser(body, count))
+	slices.Sort(failed)
+	failed = slices.Compact(failed)
+	for _, i := range failed {
+		if i < 0 || i >= count {
+			return nil
+		}
+	}
+
+	return failed
+}
+
+// sanitizeUTF8 handles the invalid UTF-8 sequences of b according to mode,
+// escaping invalid bytes with the given format.
+func sanitizeUTF8(b []byte, mode InvalidUTF8, escape string) []byte {
+	if mode == InvalidUTF8Keep || utf8.Valid(b) {
+		return b
+	}
+	if mode == InvalidUTF8Replace {
+		return bytes.ToValidUTF8(b, []byte("\uFFFD"))
+	}
+
+	out := make([]byte, 0, len(b)+16)
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			out = fmt.Appendf(out, escape, b[0])
+		} else {
+			out = append(out, b[:size]...)
+		}
+		b = b[size:]
+	}
+
+	return out
+}
+
+// sleepContext sleeps for d, returning false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	crand.Read(b[:]) // nolint: errcheck
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,75 @@
+package logx
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+var publishMu sync.Mutex
+
+// lokiCounters holds the counters maintained by a LokiClient.
+type lokiCounters struct {
+	accepted         atomic.Int64
+	dropped          atomic.Int64
+	bufferFull       atomic.Int64
+	schemaViolations atomic.Int64
+	outOfOrder       atomic.Int64
+	batchesSent      atomic.Int64
+	batchesFailed    atomic.Int64
+	bytesSent        atomic.Int64
+}
+
+// publish registers the counters as an expvar map named after the namespace.
+// It returns false, without panicking, when the name is already taken.
+func (m *lokiCounters) publish(namespace string) bool {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	if expvar.Get(namespace) != nil {
+		return false
+	}
+
+	vars := new(expvar.Map)
+	vars.Set("logs_accepted", expvar.Func(func() any { return m.accepted.Load() }))
+	vars.Set("logs_dropped", expvar.Func(func() any { return m.dropped.Load() }))
+	vars.Set("logs_dropped_buffer_full", expvar.Func(func() any { return m.bufferFull.Load() }))
+	vars.Set("schema_violations", expvar.Func(func() any { return m.schemaViolations.Load() }))
+	vars.Set("out_of_order", expvar.Func(func() any { return m.outOfOrder.Load() }))
+	vars.Set("batches_sent", expvar.Func(func() any { return m.batchesSent.Load() }))
+	vars.Set("batches_failed", expvar.Func(func() any { return m.batchesFailed.Load() }))
+	vars.Set("bytes_sent", expvar.Func(func() any { return m.bytesSent.Load() }))
+	expvar.Publish(namespace, vars)
+
+	return true
+}
+
+// LokiStats is a snapshot of the counters of a LokiClient.
+type LokiStats struct {
+	Accepted int64
+	// Dropped counts all the dropped logs, BufferFull only those dropped
+	// because the buffer was full.
+	Dropped          int64
+	BufferFull       int64
+	SchemaViolations int64
+	// OutOfOrder counts the entries older than the previous entry of their
+	// stream, a hint of clock issues.
+	OutOfOrder    int64
+	BatchesSent   int64
+	BatchesFailed int64
+	BytesSent     int64
+}
+
+// Stats returns the current counters of the client.
+func (c *LokiClient) Stats() LokiStats {
+	return LokiStats{
+		Accepted:         c.metrics.accepted.Load(),
+		Dropped:          c.metrics.dropped.Load(),
+		BufferFull:       c.metrics.bufferFull.Load(),
+		SchemaViolations: c.metrics.schemaViolations.Load(),
+		OutOfOrder:       c.metrics.outOfOrder.Load(),
+		BatchesSent:      c.metrics.batchesSent.Load(),
+		BatchesFailed:    c.metrics.batchesFailed.Load(),
+		BytesSent:        c.metrics.bytesSent.Load(),
+	}
+}
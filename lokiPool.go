@@ -0,0 +1,61 @@
+package logx
+
+import (
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Pools of the value tuples and metadata maps of the entries, which are
+// released once their batch is delivered. A batch which failed is never
+// released, as it may still be referenced by the retry queue.
+var (
+	tuplePool    = sync.Pool{New: func() any { return new([3]any) }}
+	metadataPool = sync.Pool{New: func() any { return make(map[string]any, 8) }}
+)
+
+// newTuple returns a [timestamp, line, metadata] value tuple.
+func newTuple(ts, line string, metadata map[string]any) []any {
+	tuple := tuplePool.Get().(*[3]any) // nolint: forcetypeassert
+	tuple[0], tuple[1], tuple[2] = ts, line, metadata
+
+	return tuple[:]
+}
+
+// newMetadata returns an empty metadata map.
+func newMetadata() map[string]any {
+	return metadataPool.Get().(map[string]any) // nolint: forcetypeassert
+}
+
+// releaseValue returns the tuple and metadata map of a value to their pools.
+// The tuple of a value without metadata is only sliced to two elements.
+func releaseValue(value []any) {
+	if cap(value) != 3 {
+		return
+	}
+	tuple := (*[3]any)(value[:3])
+	if metadata, ok := tuple[2].(map[string]any); ok {
+		releaseMetadata(metadata)
+	}
+	clear(tuple[:])
+	tuplePool.Put(tuple)
+}
+
+// releaseMetadata returns a metadata map to its pool.
+func releaseMetadata(metadata map[string]any) {
+	clear(metadata)
+	metadataPool.Put(metadata)
+}
+
+// cloneValue copies a value tuple and its metadata map, so it outlives the
+// release of the original.
+func cloneValue(value []any) []any {
+	clone := slices.Clone(value)
+	if len(clone) > 2 {
+		if metadata, ok := clone[2].(map[string]any); ok {
+			clone[2] = maps.Clone(metadata)
+		}
+	}
+
+	return clone
+}
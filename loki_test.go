@@ -1,14 +1,132 @@
 package logx_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/alex-cos/logx"
+	"github.com/golang/snappy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
+// lokiServer is a fake Loki push endpoint recording every request body.
+type lokiServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	paths   []string
+	bodies  [][]byte
+	headers []http.Header
+}
+
+func newLokiServer(t *testing.T, handler http.HandlerFunc) *lokiServer {
+	t.Helper()
+
+	s := &lokiServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.paths = append(s.paths, r.Method+" "+r.URL.Path)
+		s.bodies = append(s.bodies, body)
+		s.headers = append(s.headers, r.Header.Clone())
+		s.mu.Unlock()
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *lokiServer) requests() ([][]byte, []http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]byte{}, s.bodies...), append([]http.Header{}, s.headers...)
+}
+
+func (s *lokiServer) requestPaths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.paths...)
+}
+
+// streams decodes every pushed body and returns the shipped streams.
+func (s *lokiServer) streams(t *testing.T) []logx.LokiStream {
+	t.Helper()
+
+	var streams []logx.LokiStream
+	bodies, _ := s.requests()
+	for _, body := range bodies {
+		if len(body) == 0 {
+			continue
+		}
+		var req struct {
+			Streams []logx.LokiStream `json:"streams"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatalf("invalid push body %q: %v", body, err)
+		}
+		streams = append(streams, req.Streams...)
+	}
+
+	return streams
+}
+
+// entries returns the value tuples of every shipped stream.
+func (s *lokiServer) entries(t *testing.T) [][]any {
+	t.Helper()
+
+	var values [][]any
+	for _, stream := range s.streams(t) {
+		values = append(values, stream.Values...)
+	}
+
+	return values
+}
+
+func newTestLokiClient(t *testing.T, s *httptest.Server, opts ...logx.Option) (*logx.LokiClient, logx.Close) {
+	t.Helper()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return logx.NewLokiClient(u.Hostname(), port, opts...)
+}
+
 func TestLokiBasicAuth(t *testing.T) {
 	t.Parallel()
 
@@ -72,3 +190,2283 @@ func TestLokiToken(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 }
+
+func TestLokiResponseHook(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		w.Header().Set("X-Loki-Ingested", strconv.Itoa(calls))
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	var statuses []int
+	var ingested []string
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithResponseHook(func(resp *http.Response) {
+			statuses = append(statuses, resp.StatusCode)
+			ingested = append(ingested, resp.Header.Get("X-Loki-Ingested"))
+		}),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("This is a test")
+	stop()
+
+	if len(statuses) != 2 || statuses[0] != http.StatusInternalServerError || statuses[1] != http.StatusNoContent {
+		t.Fatalf("unexpected statuses seen by hook: %v", statuses)
+	}
+	if ingested[0] != "1" || ingested[1] != "2" {
+		t.Fatalf("unexpected X-Loki-Ingested headers seen by hook: %v", ingested)
+	}
+}
+
+func TestLokiMaxBufferMemory(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithMaxBufferMemory(2500),
+		logx.WithWriteTimeout(10*time.Millisecond),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+
+	large := strings.Repeat("x", 1200)
+	logger.Info("small 1")
+	logger.Info("large 1", "payload", large)
+	logger.Info("large 2", "payload", large)
+	logger.Info("small 2")
+	stop()
+
+	var msgs []string
+	for _, e := range srv.entries(t) {
+		msgs = append(msgs, e[1].(string))
+	}
+	if strings.Join(msgs, ",") != "small 1,large 1,small 2" {
+		t.Fatalf("unexpected shipped entries: %v", msgs)
+	}
+}
+
+func TestLokiDiagnosticsWriter(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	var diagnostics bytes.Buffer
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithMaxBufferMemory(10),
+		logx.WithDiagnosticsWriter(&diagnostics),
+	)
+	defer stop()
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+
+	logger.Info("This is a test")
+
+	if !strings.Contains(diagnostics.String(), "[LokiClient] buffer memory limit reached, dropping log") {
+		t.Fatalf("unexpected diagnostics: %q", diagnostics.String())
+	}
+}
+
+func TestLokiAllowedLabelKeys(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	var diagnostics bytes.Buffer
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithDiagnosticsWriter(&diagnostics),
+		logx.WithAllowedLabelKeys("app", "env"),
+		logx.WithLabels(map[string]string{
+			"app":     "my_app",
+			"enviorn": "dev",
+		}),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("This is a test")
+	stop()
+
+	bodies, _ := srv.requests()
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 push, got %d", len(bodies))
+	}
+	if !strings.Contains(string(bodies[0]), `"stream":{"app":"my_app"}`) {
+		t.Fatalf("unexpected stream labels: %s", bodies[0])
+	}
+	if !strings.Contains(diagnostics.String(), `label "enviorn" is not allowed`) {
+		t.Fatalf("missing warning, got %q", diagnostics.String())
+	}
+}
+
+func TestLokiIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithIdempotencyKey(true),
+		logx.WithBatchSize(1),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("first batch")
+	logger.Info("second batch")
+	stop()
+
+	_, headers := srv.requests()
+	if len(headers) != 3 {
+		t.Fatalf("expected 3 pushes, got %d", len(headers))
+	}
+	keys := make([]string, 0, len(headers))
+	for _, h := range headers {
+		keys = append(keys, h.Get("X-Loki-Idempotency-Key"))
+	}
+	if keys[0] == "" || keys[0] != keys[1] {
+		t.Fatalf("expected the same key across retries, got %v", keys)
+	}
+	if keys[2] == "" || keys[2] == keys[0] {
+		t.Fatalf("expected a new key for the second batch, got %v", keys)
+	}
+}
+
+func TestLokiIdempotencyKeyResend(t *testing.T) {
+	t.Parallel()
+
+	keys := func(s *lokiServer) []string {
+		_, headers := s.requests()
+		keys := make([]string, 0, len(headers))
+		for _, h := range headers {
+			keys = append(keys, h.Get("X-Loki-Idempotency-Key"))
+		}
+
+		return keys
+	}
+
+	// A batch resent from the retry queue keeps its key.
+	calls := 0
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithIdempotencyKey(true),
+		logx.WithRetries(0),
+		logx.WithRetryQueue(time.Minute),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+	if k := keys(srv); len(k) != 2 || k[0] == "" || k[0] != k[1] {
+		t.Fatalf("expected the queued batch to keep its key, got %v", k)
+	}
+
+	// So do the batches spilled to disk, sent as they were.
+	dir := t.TempDir()
+	down := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	loki, _ = newTestLokiClient(t, down.Server,
+		logx.WithIdempotencyKey(true),
+		logx.WithRetries(0),
+		logx.WithBatchSize(1),
+		logx.WithDiskBuffer(dir, 1<<20),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("first")
+	logger.Info("second")
+	loki.CloseE() // nolint: errcheck
+
+	up := newLokiServer(t, nil)
+	loki, _ = newTestLokiClient(t, up.Server, logx.WithDiskBuffer(dir, 1<<20))
+	if err := loki.CloseE(); err != nil {
+		t.Fatal(err)
+	}
+	if spilled, drained := keys(down), keys(up); fmt.Sprint(spilled) != fmt.Sprint(drained) || spilled[0] == spilled[1] {
+		t.Fatalf("expected the spilled batches to keep their keys, got %v then %v", spilled, drained)
+	}
+}
+
+func TestLokiLineFunc(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithLineFunc(func(values map[string]any) string {
+			return fmt.Sprintf("%s %s status=%v", values["level"], values["msg"], values["status"])
+		}),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("GET /index.html", "status", 200)
+	stop()
+
+	entries := srv.entries(t)
+	if len(entries) != 1 || entries[0][1] != "info GET /index.html status=200" {
+		t.Fatalf("unexpected shipped entries: %v", entries)
+	}
+}
+
+func TestLokiMetricsNamespace(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	var diagnostics bytes.Buffer
+	tenantA, stopA := newTestLokiClient(t, srv.Server, logx.WithMetricsNamespace("logx_test_tenant_a"))
+	defer stopA()
+	_, stopB := newTestLokiClient(t, srv.Server, logx.WithMetricsNamespace("logx_test_tenant_b"))
+	defer stopB()
+	_, stopC := newTestLokiClient(t, srv.Server,
+		logx.WithMetricsNamespace("logx_test_tenant_b"),
+		logx.WithDiagnosticsWriter(&diagnostics),
+	)
+	defer stopC()
+
+	logx.New([]io.Writer{tenantA}, "Debug", true, true).Info("This is a test")
+
+	if v := expvar.Get("logx_test_tenant_a"); v == nil || !strings.Contains(v.String(), `"logs_accepted": 1`) {
+		t.Fatalf("unexpected tenant_a metrics: %v", v)
+	}
+	if v := expvar.Get("logx_test_tenant_b"); v == nil || !strings.Contains(v.String(), `"logs_accepted": 0`) {
+		t.Fatalf("unexpected tenant_b metrics: %v", v)
+	}
+	if !strings.Contains(diagnostics.String(), `metrics namespace "logx_test_tenant_b" is already registered`) {
+		t.Fatalf("missing duplicate namespace warning, got %q", diagnostics.String())
+	}
+}
+
+func TestLokiJSONLineOrder(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithJSONLine(true))
+	input := []byte(`{"zeta":1,"msg":"hello","alpha":{"b":2,"a":1},"level":"info",` +
+		`"time":"2025-01-02T03:04:05.000Z","beta":"x"}`)
+	for range 20 {
+		if _, err := loki.Write(input); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop()
+
+	expected := `{"time":"2025-01-02T03:04:05.000Z","level":"info","msg":"hello",` +
+		`"alpha":{"a":1,"b":2},"beta":"x","zeta":1}`
+	entries := srv.entries(t)
+	if len(entries) != 20 {
+		t.Fatalf("expected 20 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e[1] != expected {
+			t.Fatalf("unexpected line %v", e[1])
+		}
+	}
+}
+
+func TestLokiOnClose(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	closed := 0
+	pushed := 0
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithOnClose(func() {
+			closed++
+			bodies, _ := srv.requests()
+			pushed = len(bodies)
+		}),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+	stop()
+
+	if closed != 1 {
+		t.Fatalf("expected the hook to run once, ran %d times", closed)
+	}
+	if pushed != 1 {
+		t.Fatalf("expected the hook to run after the drain, saw %d pushes", pushed)
+	}
+}
+
+func TestLokiOnCloseAfterTimeout(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	closed := make(chan logx.LokiStats, 1)
+	var loki *logx.LokiClient
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithStopTimeout(50*time.Millisecond),
+		logx.WithDiagnosticsWriter(io.Discard),
+		logx.WithOnClose(func() { closed <- loki.Stats() }),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	// The hook runs once the final flush has given up, not during it.
+	select {
+	case stats := <-closed:
+		if stats.BatchesFailed != 1 {
+			t.Fatalf("hook ran before the end of the final flush: %+v", stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook not run after the stop timeout")
+	}
+}
+
+func TestLokiAdaptiveBatching(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		if calls <= 2 {
+			time.Sleep(150 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithBatchSize(8),
+		logx.WithSendTimeout(time.Second),
+		logx.WithAdaptiveBatching(2, 16),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	for i := range 8 + 4 + 2 + 4 + 8 + 16 {
+		logger.Info("This is a test", "i", i)
+	}
+	stop()
+
+	var sizes []int
+	bodies, _ := srv.requests()
+	for _, body := range bodies {
+		sizes = append(sizes, strings.Count(string(body), `"This is a test"`))
+	}
+	if fmt.Sprint(sizes) != "[8 4 2 4 8 16]" {
+		t.Fatalf("unexpected batch sizes: %v", sizes)
+	}
+}
+
+func TestLokiRawLines(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithRawLines(true))
+	line := `127.0.0.1 - - [02/Jan/2025:03:04:05 +0000] "GET / HTTP/1.1" 200 512`
+	if _, err := loki.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	entries := srv.entries(t)
+	if len(entries) != 1 || entries[0][1] != line {
+		t.Fatalf("unexpected shipped entries: %v", entries)
+	}
+}
+
+func TestLokiDuplicateTimestamp(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		strategy logx.DuplicateTimestamp
+		expected []string
+	}{
+		{"increment", logx.DuplicateIncrement, []string{
+			"1735787045000000000", "1735787045000000001", "1735787045000000002",
+		}},
+		{"drop", logx.DuplicateDrop, []string{"1735787045000000000"}},
+		{"keep", logx.DuplicateKeep, []string{
+			"1735787045000000000", "1735787045000000000", "1735787045000000000",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := newLokiServer(t, nil)
+			loki, stop := newTestLokiClient(t, srv.Server, logx.WithDuplicateTimestamp(tt.strategy))
+			for range 3 {
+				if _, err := loki.Write([]byte(`{"time":"2025-01-02T03:04:05.000Z","msg":"hello"}`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stop()
+
+			var timestamps []string
+			for _, e := range srv.entries(t) {
+				timestamps = append(timestamps, e[0].(string))
+			}
+			if fmt.Sprint(timestamps) != fmt.Sprint(tt.expected) {
+				t.Fatalf("unexpected timestamps: %v", timestamps)
+			}
+		})
+	}
+}
+
+func TestLokiDuplicateTimestampIncrement(t *testing.T) {
+	t.Parallel()
+
+	loki, captured := logx.NewLokiTestClient()
+	for _, ts := range []string{"000", "000", "000", "000000001", "000000005"} {
+		if _, err := loki.Write([]byte(`{"time":"2025-01-02T03:04:05.` + ts + `Z","msg":"hello"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The real timestamp 1 comes after the ones nudged to 1 and 2.
+	var timestamps []string
+	for _, v := range captured() {
+		timestamps = append(timestamps, strings.TrimPrefix(v[0].(string), "17357870450000000"))
+	}
+	if fmt.Sprint(timestamps) != "[00 01 02 03 05]" {
+		t.Fatalf("unexpected timestamps: %v", timestamps)
+	}
+}
+
+func TestLokiSplitLongLines(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithMaxLineBytes(10),
+		logx.WithSplitLongLines(true),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("0123456789abcdefghij0123")
+	stop()
+
+	entries := srv.entries(t)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", entries)
+	}
+	var line strings.Builder
+	for i, e := range entries {
+		line.WriteString(e[1].(string))
+		metadata := e[2].(map[string]any)
+		if metadata["part"] != strconv.Itoa(i+1) || metadata["parts"] != "3" {
+			t.Fatalf("unexpected part metadata: %v", metadata)
+		}
+		if metadata["split_id"] == "" || metadata["split_id"] != entries[0][2].(map[string]any)["split_id"] {
+			t.Fatalf("expected a shared split id: %v", metadata)
+		}
+	}
+	if line.String() != "0123456789abcdefghij0123" {
+		t.Fatalf("unexpected reassembled line: %q", line.String())
+	}
+}
+
+func TestLokiConnectionWarmup(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ready" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	var dials atomic.Int32
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithHttpClient(&http.Client{Transport: transport}),
+		logx.WithConnectionWarmup(true),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	paths := srv.requestPaths()
+	if fmt.Sprint(paths) != "[GET /ready POST /loki/api/v1/push]" {
+		t.Fatalf("unexpected requests: %v", paths)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("expected the push to reuse the warmed up connection, got %d dials", n)
+	}
+}
+
+func TestLokiNumericLevels(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithNumericLevels(logx.BunyanLevel))
+	for i, level := range []int{10, 20, 30, 40, 50, 60} {
+		input := fmt.Sprintf(`{"time":"2025-01-02T03:04:05.00%dZ","level":%d,"msg":"hello"}`, i, level)
+		if _, err := loki.Write([]byte(input)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop()
+
+	var levels []string
+	for _, e := range srv.entries(t) {
+		levels = append(levels, e[2].(map[string]any)["level"].(string))
+	}
+	if fmt.Sprint(levels) != "[debug debug info warn error error]" {
+		t.Fatalf("unexpected levels: %v", levels)
+	}
+}
+
+func TestLokiMaxRetryDuration(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithMaxRetryDuration(500*time.Millisecond),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("retry loop exceeded its cap: %s", elapsed)
+	}
+	if bodies, _ := srv.requests(); len(bodies) != 1 {
+		t.Fatalf("expected a single attempt within the cap, got %d", len(bodies))
+	}
+}
+
+func TestLokiMaxRetryDurationAttempt(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithSendTimeout(5*time.Second),
+		logx.WithMaxRetryDuration(200*time.Millisecond),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("hung attempt exceeded the retry cap: %s", elapsed)
+	}
+}
+
+type textSerializer struct{}
+
+func (textSerializer) Marshal(streams []logx.LokiStream) ([]byte, string, error) {
+	var buf bytes.Buffer
+	for _, stream := range streams {
+		for _, v := range stream.Values {
+			fmt.Fprintf(&buf, "%s\n", v[1])
+		}
+	}
+
+	return buf.Bytes(), "text/plain", nil
+}
+
+func TestLokiSerializer(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithSerializer(textSerializer{}))
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	bodies, headers := srv.requests()
+	if len(bodies) != 1 || string(bodies[0]) != "This is a test\n" {
+		t.Fatalf("unexpected bodies: %q", bodies)
+	}
+	if ct := headers[0].Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+}
+
+func TestLokiResource(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithResource(map[string]string{
+		"service.name":           "checkout",
+		"service.namespace":      "shop",
+		"deployment.environment": "prod",
+		"team.owner":             "payments",
+	}))
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	bodies, _ := srv.requests()
+	expected := `"stream":{"env":"prod","namespace":"shop","service":"checkout","team_owner":"payments"}`
+	if len(bodies) != 1 || !strings.Contains(string(bodies[0]), expected) {
+		t.Fatalf("unexpected stream labels: %q", bodies)
+	}
+}
+
+func TestLokiStopTimeout(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithStopTimeout(200*time.Millisecond),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	srv.Close()
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("close did not honor its timeout: %s", elapsed)
+	}
+}
+
+func TestLokiDropReport(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithDropReport(true),
+		logx.WithMaxLineBytes(10),
+		logx.WithDiagnosticsWriter(io.Discard),
+		logx.WithLabels(map[string]string{"app": "my_app"}),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("kept")
+	logger.Info("dropped, too long")
+	logger.Info("dropped, too long")
+	stop()
+
+	streams := srv.streams(t)
+	if len(streams) != 2 {
+		t.Fatalf("expected 2 streams, got %v", streams)
+	}
+	report := streams[1]
+	if report.Stream["__meta__"] != "dropped" || report.Stream["app"] != "my_app" {
+		t.Fatalf("unexpected report labels: %v", report.Stream)
+	}
+	if len(report.Values) != 1 || report.Values[0][1] != "2 logs dropped" {
+		t.Fatalf("unexpected report entries: %v", report.Values)
+	}
+}
+
+func TestLokiContentType(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithContentType("application/json; charset=utf-8"))
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	_, headers := srv.requests()
+	if len(headers) != 1 || headers[0].Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Fatalf("unexpected headers: %v", headers)
+	}
+}
+
+func TestLokiInvalidLabel(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	var diagnostics bytes.Buffer
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithDiagnosticsWriter(&diagnostics),
+		logx.WithLabels(map[string]string{
+			"app":          "my_app",
+			"service-name": "my_service",
+		}),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	if !strings.Contains(diagnostics.String(), `label "service-name" is not a valid Loki label name`) {
+		t.Fatalf("invalid label not flagged, got %q", diagnostics.String())
+	}
+	if streams := srv.streams(t); len(streams) != 1 || fmt.Sprint(streams[0].Stream) != "map[app:my_app]" {
+		t.Fatalf("unexpected streams: %v", streams)
+	}
+}
+
+type requestIDKey struct{}
+
+func TestLokiEnrichment(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithEnrichment(func(ctx context.Context, values map[string]any) {
+			if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+				values["request_id"] = id
+			}
+		}),
+	)
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-42")
+	if _, err := loki.WriteContext(ctx, []byte(`{"time":"2025-01-02T03:04:05.000Z","msg":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	entries := srv.entries(t)
+	if len(entries) != 1 || entries[0][2].(map[string]any)["request_id"] != "req-42" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestLokiInvalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		mode     logx.InvalidUTF8
+		raw      bool
+		input    string
+		expected string
+	}{
+		// The JSON push replaces each invalid byte kept.
+		{"raw keep", logx.InvalidUTF8Keep, true, "bad \xff\xfe bytes", "bad �� bytes"},
+		{"raw replace", logx.InvalidUTF8Replace, true, "bad \xff\xfe bytes", "bad � bytes"},
+		{"raw escape", logx.InvalidUTF8Escape, true, "bad \xff\xfe bytes", `bad \xff\xfe bytes`},
+		{
+			"json keep", logx.InvalidUTF8Keep, false,
+			"{\"time\":\"2025-01-02T03:04:05.000Z\",\"msg\":\"bad \xff\xfe bytes\"}", "bad �� bytes",
+		},
+		{
+			"json replace", logx.InvalidUTF8Replace, false,
+			"{\"time\":\"2025-01-02T03:04:05.000Z\",\"msg\":\"bad \xff\xfe bytes\"}", "bad � bytes",
+		},
+		{
+			"json escape", logx.InvalidUTF8Escape, false,
+			"{\"time\":\"2025-01-02T03:04:05.000Z\",\"msg\":\"bad \xff bytes\"}", `bad \xff bytes`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := newLokiServer(t, nil)
+			loki, stop := newTestLokiClient(t, srv.Server,
+				logx.WithRawLines(tt.raw),
+				logx.WithInvalidUTF8(tt.mode),
+			)
+			if _, err := loki.Write([]byte(tt.input)); err != nil {
+				t.Fatal(err)
+			}
+			stop()
+
+			entries := srv.entries(t)
+			if len(entries) != 1 || entries[0][1] != tt.expected {
+				t.Fatalf("unexpected entries: %q", entries)
+			}
+		})
+	}
+}
+
+func TestLokiBatchJitter(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	start := time.Now()
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithPeriod(200*time.Millisecond),
+		logx.WithBatchJitter(0.5),
+	)
+	defer stop()
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	for {
+		if bodies, _ := srv.requests(); len(bodies) > 0 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("no periodic flush happened")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Fatalf("first flush outside of the jittered range: %s", elapsed)
+	}
+}
+
+func TestLokiQueueDropOldest(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithBatchSize(1),
+		logx.WithBufferSize(2),
+		logx.WithQueueFullPolicy(logx.QueueDropOldest),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+
+	logger.Info("e1")
+	for {
+		if bodies, _ := srv.requests(); len(bodies) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, msg := range []string{"e2", "e3", "e4", "e5"} {
+		logger.Info(msg)
+	}
+	close(release)
+	stop()
+
+	var msgs []string
+	for _, e := range srv.entries(t) {
+		msgs = append(msgs, e[1].(string))
+	}
+	if fmt.Sprint(msgs) != "[e1 e4 e5]" {
+		t.Fatalf("unexpected shipped entries: %v", msgs)
+	}
+}
+
+func TestLokiQueueDropWithRoom(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []logx.QueueFullPolicy{logx.QueueDropNewest, logx.QueueDropOldest} {
+		srv := newLokiServer(t, nil)
+		loki, stop := newTestLokiClient(t, srv.Server,
+			logx.WithBatchSize(1000),
+			logx.WithQueueFullPolicy(policy),
+			logx.WithDiagnosticsWriter(io.Discard),
+		)
+		logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+		for i := range 500 {
+			logger.Info("entry", "i", i)
+		}
+		stop()
+
+		if stats := loki.Stats(); stats.Accepted != 500 || stats.Dropped != 0 {
+			t.Fatalf("policy %d dropped logs with room in the buffer: %+v", policy, stats)
+		}
+	}
+}
+
+func TestLokiTimeSkewCorrection(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithTimeSkewCorrection(time.Minute))
+	future := time.Now().Add(24 * time.Hour).UTC().Format(logx.DateTimeFormatMilli)
+	if _, err := loki.Write([]byte(`{"time":"` + future + `","msg":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	entries := srv.entries(t)
+	if len(entries) != 1 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	ts, err := strconv.ParseInt(entries[0][0].(string), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(time.Unix(0, ts)); d > time.Minute {
+		t.Fatalf("timestamp not clamped, %s ahead", d)
+	}
+}
+
+func TestLokiPartialRetry(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"failed_streams":[0]}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithFailedStreams(logx.ParseFailedStreams),
+		logx.WithDropReport(true),
+		logx.WithMaxLineBytes(10),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("kept")
+	logger.Info("dropped, too long")
+	stop()
+
+	bodies, _ := srv.requests()
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 pushes, got %d", len(bodies))
+	}
+	if n := strings.Count(string(bodies[0]), `"stream":`); n != 2 {
+		t.Fatalf("expected 2 streams in the first push, got %d", n)
+	}
+	if n := strings.Count(string(bodies[1]), `"stream":`); n != 1 || !strings.Contains(string(bodies[1]), `"kept"`) {
+		t.Fatalf("expected only the failed stream to be retried, got %s", bodies[1])
+	}
+}
+
+func TestLokiPartialRetryDisabled(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"failed_streams":[0]}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithAutoLabelKeys("service"),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("x", "service", "x")
+	logger.Info("y", "service", "y")
+	stop()
+
+	// Without a parser, the body is not trusted and the whole batch is retried.
+	bodies, _ := srv.requests()
+	if len(bodies) != 2 || !bytes.Equal(bodies[0], bodies[1]) {
+		t.Fatalf("expected the whole batch to be retried, got %q", bodies)
+	}
+}
+
+func TestLokiPartialRetryIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"failed_streams":[0]}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithFailedStreams(logx.ParseFailedStreams),
+		logx.WithIdempotencyKey(true),
+		logx.WithAutoLabelKeys("service"),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("x", "service", "x")
+	logger.Info("y", "service", "y")
+	stop()
+
+	_, headers := srv.requests()
+	if len(headers) != 2 {
+		t.Fatalf("expected 2 pushes, got %d", len(headers))
+	}
+	first, retry := headers[0].Get("X-Loki-Idempotency-Key"), headers[1].Get("X-Loki-Idempotency-Key")
+	if first == "" || retry == "" || first == retry {
+		t.Fatalf("expected a new key for the partial retry, got %q and %q", first, retry)
+	}
+}
+
+func TestLokiRetryQueue(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithPeriod(100*time.Millisecond),
+		logx.WithMaxRetryDuration(10*time.Millisecond),
+		logx.WithRetryQueue(time.Minute),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	defer stop()
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	start := time.Now()
+	for {
+		bodies, _ := srv.requests()
+		if len(bodies) == 2 {
+			if !strings.Contains(string(bodies[1]), `"This is a test"`) {
+				t.Fatalf("unexpected delayed retry body: %s", bodies[1])
+			}
+			return
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("batch not delivered by the retry queue, got %d pushes", len(bodies))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLokiRetryQueueBounds(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithBatchSize(1),
+		logx.WithPeriod(time.Hour),
+		logx.WithBackoff(logx.LinearBackoff{Attempts: 1, Step: 0, Jitter: 0}),
+		logx.WithRetryQueue(time.Minute),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	for i := range 105 {
+		logger.Info("entry", "i", i)
+	}
+	stop()
+
+	// The final pass over the queue stops at its first failure.
+	if bodies, _ := srv.requests(); len(bodies) != 106 {
+		t.Fatalf("expected a push per batch and a single resend, got %d", len(bodies))
+	}
+	if stats := loki.Stats(); stats.BatchesFailed != 5 {
+		t.Fatalf("expected the batches over the queue size to be given up: %+v", stats)
+	}
+}
+
+func TestLokiAutoLabelKeys(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithAutoLabelKeys("service", "env"),
+		logx.WithLabels(map[string]string{"app": "my_app"}),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.With("service", "billing", "env", "prod").Info("first", "user", "42")
+	logger.With("service", "checkout").Info("second")
+	logger.Info("third")
+	stop()
+
+	streams := srv.streams(t)
+	if len(streams) != 3 {
+		t.Fatalf("expected 3 streams, got %v", streams)
+	}
+	expected := []string{
+		"map[app:my_app env:prod service:billing]",
+		"map[app:my_app service:checkout]",
+		"map[app:my_app]",
+	}
+	for i, stream := range streams {
+		if fmt.Sprint(stream.Stream) != expected[i] {
+			t.Fatalf("unexpected labels for stream %d: %v", i, stream.Stream)
+		}
+	}
+	metadata := streams[0].Values[0][2].(map[string]any)
+	if _, ok := metadata["env"]; ok || metadata["user"] != "42" {
+		t.Fatalf("unexpected metadata: %v", metadata)
+	}
+}
+
+type recordingBackoff struct {
+	attempts []int
+	statuses []int
+}
+
+func (b *recordingBackoff) NextDelay(attempt int, resp *http.Response, _ error) (time.Duration, bool) {
+	b.attempts = append(b.attempts, attempt)
+	if resp != nil {
+		b.statuses = append(b.statuses, resp.StatusCode)
+	}
+
+	return 10 * time.Millisecond, attempt < 2
+}
+
+func TestLokiBackoff(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	backoff := &recordingBackoff{}
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithBackoff(backoff),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("custom backoff delays were not used: %s", elapsed)
+	}
+	if bodies, _ := srv.requests(); len(bodies) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(bodies))
+	}
+	if !slices.Equal(backoff.attempts, []int{0, 1, 2}) {
+		t.Fatalf("unexpected attempts: %v", backoff.attempts)
+	}
+	if !slices.Equal(backoff.statuses, []int{500, 500, 500}) {
+		t.Fatalf("unexpected statuses: %v", backoff.statuses)
+	}
+}
+
+func TestLokiRequiredFields(t *testing.T) {
+	t.Parallel()
+
+	record := []byte(`{"time":"2025-01-02T03:04:05.000Z","msg":"hello","service":"api"}`)
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithRequiredFields("service", "request_id"))
+	if _, err := loki.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	entries := srv.entries(t)
+	if len(entries) != 1 || entries[0][2].(map[string]any)["__schema_violation__"] != "request_id" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+
+	srv = newLokiServer(t, nil)
+	loki, stop = newTestLokiClient(t, srv.Server,
+		logx.WithRequiredFields("service", "request_id"),
+		logx.WithSchemaViolation(logx.SchemaViolationDrop),
+		logx.WithMetricsNamespace("logx_test_schema"),
+	)
+	if _, err := loki.Write(record); !errors.Is(err, logx.ErrSchemaViolation) {
+		t.Fatalf("expected a schema violation, got %v", err)
+	}
+	stop()
+
+	if entries := srv.entries(t); len(entries) != 0 {
+		t.Fatalf("expected the record to be dropped: %v", entries)
+	}
+	if v := expvar.Get("logx_test_schema"); v == nil || !strings.Contains(v.String(), `"schema_violations": 1`) {
+		t.Fatalf("unexpected metrics: %v", v)
+	}
+}
+
+func TestLokiCloseE(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, _ := newTestLokiClient(t, srv.Server)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	if err := loki.CloseE(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	loki, _ = newTestLokiClient(t, down,
+		logx.WithBackoff(logx.LinearBackoff{Attempts: 1, Step: 0, Jitter: 0}),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	if err := loki.CloseE(); err == nil {
+		t.Fatal("expected the final send error")
+	}
+	if err := loki.CloseE(); err == nil {
+		t.Fatal("expected the final send error on a second close")
+	}
+}
+
+func TestLokiJSONArraySplit(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithJSONArraySplit(true))
+	input := `[{"time":"2025-01-02T03:04:05.000Z","msg":"first"},{"msg":"second","id":2}]`
+	if _, err := loki.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	entries := srv.entries(t)
+	if len(entries) != 2 || entries[0][1] != "first" || entries[1][1] != "second" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if entries[1][2].(map[string]any)["id"] != "2" {
+		t.Fatalf("unexpected metadata: %v", entries[1][2])
+	}
+}
+
+type recordingTracer struct {
+	noop.Tracer
+
+	spans []*recordingSpan
+}
+
+func (tr *recordingTracer) Start(ctx context.Context, _ string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordingSpan{attributes: make(map[attribute.Key]attribute.Value)}
+	tr.spans = append(tr.spans, span)
+
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type recordingSpan struct {
+	noop.Span
+
+	attributes map[attribute.Key]attribute.Value
+	errors     int
+	ended      bool
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attributes[a.Key] = a.Value
+	}
+}
+
+func (s *recordingSpan) RecordError(error, ...trace.EventOption) {
+	s.errors++
+}
+
+func (s *recordingSpan) End(...trace.SpanEndOption) {
+	s.ended = true
+}
+
+func TestLokiTracer(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tracer := &recordingTracer{}
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithTracer(tracer),
+		logx.WithBackoff(logx.LinearBackoff{Attempts: 3, Step: time.Millisecond, Jitter: 0}),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected a span per attempt, got %d", len(tracer.spans))
+	}
+	for i, span := range tracer.spans {
+		if !span.ended || span.attributes["loki.attempt"].AsInt64() != int64(i) ||
+			span.attributes["loki.batch.entries"].AsInt64() != 1 {
+			t.Fatalf("unexpected span %d: %+v", i, span)
+		}
+	}
+	if tracer.spans[0].errors != 1 || tracer.spans[0].attributes["http.response.status_code"].AsInt64() != 500 {
+		t.Fatalf("expected the first attempt to record its error: %+v", tracer.spans[0])
+	}
+	if tracer.spans[1].errors != 0 || tracer.spans[1].attributes["http.response.status_code"].AsInt64() != 204 {
+		t.Fatalf("expected the second attempt to succeed: %+v", tracer.spans[1])
+	}
+}
+
+func TestLokiHostnameLabel(t *testing.T) {
+	t.Parallel()
+
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithHostnameLabel(""), logx.WithHostnameLabel("node"))
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	streams := srv.streams(t)
+	if len(streams) != 1 || streams[0].Stream["host"] != host || streams[0].Stream["node"] != host {
+		t.Fatalf("unexpected streams: %v", streams)
+	}
+}
+
+func TestLokiExpectedStatus(t *testing.T) {
+	t.Parallel()
+
+	html := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "<html><body>Proxy error</body></html>")
+	})
+	loki, _ := newTestLokiClient(t, html.Server,
+		logx.WithEmptyResponse(true),
+		logx.WithBackoff(logx.LinearBackoff{Attempts: 1, Step: 0, Jitter: 0}),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	if err := loki.CloseE(); err == nil {
+		t.Fatal("expected an HTML page to be a failure")
+	}
+
+	accepted := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	loki, _ = newTestLokiClient(t, accepted.Server,
+		logx.WithExpectedStatus(http.StatusAccepted),
+		logx.WithEmptyResponse(true),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	if err := loki.CloseE(); err != nil {
+		t.Fatalf("expected 202 to be a success: %v", err)
+	}
+}
+
+func BenchmarkLokiWrite(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) // nolint: errcheck
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		b.Fatal(err)
+	}
+	loki, stop := logx.NewLokiClient(u.Hostname(), port,
+		logx.WithBatchSize(1000),
+		logx.WithQueueFullPolicy(logx.QueueBlock),
+	)
+	record := []byte(`{"time":"2025-01-02T03:04:05.000Z","level":"info","msg":"hello","user":"alice","id":42}`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := loki.Write(record); err != nil {
+			b.Fatal(err)
+		}
+	}
+	stop()
+}
+
+func TestLokiOnDrop(t *testing.T) {
+	t.Parallel()
+
+	var dropped []string
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithMaxLineBytes(10),
+		logx.WithRequiredFields("id"),
+		logx.WithSchemaViolation(logx.SchemaViolationDrop),
+		logx.WithDiagnosticsWriter(io.Discard),
+		logx.WithOnDrop(func(entry []byte) {
+			dropped = append(dropped, string(entry))
+		}),
+	)
+
+	long := `{"time":"2025-01-02T03:04:05.000Z","msg":"a message longer than the limit","id":1}`
+	missing := `{"time":"2025-01-02T03:04:05.000Z","msg":"short"}`
+	if _, err := loki.Write([]byte(long)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loki.Write([]byte(missing)); err == nil {
+		t.Fatal("expected a schema violation")
+	}
+	stop()
+
+	if !slices.Equal(dropped, []string{long, missing}) {
+		t.Fatalf("unexpected dropped records: %q", dropped)
+	}
+	if entries := srv.entries(t); len(entries) != 0 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestLokiTestClient(t *testing.T) {
+	t.Parallel()
+
+	loki, captured := logx.NewLokiTestClient(logx.WithBatchSize(2))
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("first", "user", "alice")
+	logger.Warn("second")
+	logger.Error("third")
+
+	values := captured()
+	if len(values) != 3 {
+		t.Fatalf("expected 3 entries, got %v", values)
+	}
+	for i, msg := range []string{"first", "second", "third"} {
+		if values[i][1] != msg {
+			t.Fatalf("unexpected entry %d: %v", i, values[i])
+		}
+	}
+	if values[0][2].(map[string]any)["user"] != "alice" {
+		t.Fatalf("unexpected metadata: %v", values[0][2])
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestLokiTestClientOffline(t *testing.T) {
+	t.Parallel()
+
+	offline := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request %s %s", req.Method, req.URL)
+		return nil, errors.New("offline")
+	})}
+	loki, captured := logx.NewLokiTestClient(logx.WithHttpClient(offline), logx.WithConnectionWarmup(true))
+	if err := loki.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	if values := captured(); len(values) != 1 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+}
+
+func TestLokiMaxMessageDepth(t *testing.T) {
+	t.Parallel()
+
+	loki, captured := logx.NewLokiTestClient(logx.WithMaxMessageDepth(2))
+	input := `{"time":"2025-01-02T03:04:05.000Z","msg":"hello","user":"alice",` +
+		`"a":{"b":{"c":{"d":{"e":"deep"}}},"f":1}}`
+	if _, err := loki.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+
+	values := captured()
+	if len(values) != 1 {
+		t.Fatalf("expected a single entry, got %v", values)
+	}
+	metadata := values[0][2].(map[string]any)
+	want := map[string]any{
+		"user": "alice",
+		"a_b":  `{"c":{"d":{"e":"deep"}}}`,
+		"a_f":  "1",
+	}
+	if len(metadata) != len(want) {
+		t.Fatalf("unexpected metadata: %v", metadata)
+	}
+	for k, v := range want {
+		if metadata[k] != v {
+			t.Fatalf("unexpected %s: %v", k, metadata[k])
+		}
+	}
+}
+
+func TestLokiResponseHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	// The listener accepts connections and reads the requests, but never
+	// answers them.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn) // nolint: errcheck
+			}()
+		}
+	}()
+
+	loki, _ := logx.NewLokiClient("127.0.0.1", listener.Addr().(*net.TCPAddr).Port,
+		logx.WithResponseHeaderTimeout(100*time.Millisecond),
+		logx.WithBackoff(logx.LinearBackoff{Attempts: 1, Step: 0, Jitter: 0}),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	start := time.Now()
+	if err := loki.CloseE(); err == nil {
+		t.Fatal("expected the push to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("push did not fail fast: %s", elapsed)
+	}
+}
+
+func TestLokiGzip(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithGzip(true), logx.WithBatchSize(1))
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("first")
+	logger.Info("second")
+	stop()
+
+	bodies, headers := srv.requests()
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(bodies))
+	}
+	for i, body := range bodies {
+		if headers[i].Get("Content-Encoding") != "gzip" {
+			t.Fatalf("unexpected headers: %v", headers[i])
+		}
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req struct {
+			Streams []logx.LokiStream `json:"streams"`
+		}
+		if err := json.NewDecoder(r).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if len(req.Streams) != 1 || req.Streams[0].Values[0][1] != []string{"first", "second"}[i] {
+			t.Fatalf("unexpected request %d: %v", i, req)
+		}
+	}
+}
+
+type protoField struct {
+	num    int
+	varint uint64
+	data   []byte
+}
+
+// protoFields decodes the varint and length-delimited fields of a protobuf
+// message.
+func protoFields(t *testing.T, b []byte) []protoField {
+	t.Helper()
+
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		b = b[n:]
+		field := protoField{num: int(tag >> 3), varint: v, data: nil}
+		switch tag & 7 {
+		case 0:
+		case 2:
+			field.data, b = b[:v], b[v:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+func TestLokiProtobuf(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithProtobuf(),
+		logx.WithLabels(map[string]string{"service": "api", "env": "dev"}),
+	)
+	if _, err := loki.Write([]byte(`{"time":"2025-01-02T03:04:05.678Z","msg":"hello","user":"alice"}`)); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	bodies, headers := srv.requests()
+	if len(bodies) != 1 || headers[0].Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("unexpected requests: %v", headers)
+	}
+	body, err := snappy.Decode(nil, bodies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := protoFields(t, body)
+	if len(streams) != 1 || streams[0].num != 1 {
+		t.Fatalf("unexpected push request: %v", streams)
+	}
+	stream := protoFields(t, streams[0].data)
+	if len(stream) != 2 || string(stream[0].data) != `{env="dev", service="api"}` {
+		t.Fatalf("unexpected stream: %v", stream)
+	}
+	entry := protoFields(t, stream[1].data)
+	if len(entry) != 3 || string(entry[1].data) != "hello" {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+	timestamp := protoFields(t, entry[0].data)
+	want := time.Date(2025, 1, 2, 3, 4, 5, 678e6, time.UTC)
+	if len(timestamp) != 2 || int64(timestamp[0].varint) != want.Unix() || int64(timestamp[1].varint) != int64(want.Nanosecond()) {
+		t.Fatalf("unexpected timestamp: %v", timestamp)
+	}
+	pair := protoFields(t, entry[2].data)
+	if len(pair) != 2 || string(pair[0].data) != "user" || string(pair[1].data) != "alice" {
+		t.Fatalf("unexpected metadata: %v", pair)
+	}
+}
+
+func TestLokiOutOfOrder(t *testing.T) {
+	t.Parallel()
+
+	loki, captured := logx.NewLokiTestClient()
+	for _, ts := range []string{"03:04:05", "03:04:03", "03:04:04", "03:04:06"} {
+		record := fmt.Sprintf(`{"time":"2025-01-02T%s.000Z","msg":"%s"}`, ts, ts)
+		if _, err := loki.Write([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values := captured()
+
+	if n := loki.Stats().OutOfOrder; n != 1 {
+		t.Fatalf("expected 1 out of order entry, got %d", n)
+	}
+	var lines []any
+	for _, v := range values {
+		lines = append(lines, v[1])
+	}
+	if !slices.Equal(lines, []any{"03:04:03", "03:04:04", "03:04:05", "03:04:06"}) {
+		t.Fatalf("entries not sorted by time: %v", lines)
+	}
+}
+
+func TestLokiTenantID(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithTenantID("team-a"),
+		logx.WithBasicAuth("johnDoe", "12345"),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	_, headers := srv.requests()
+	if len(headers) != 1 || headers[0].Get("X-Scope-OrgID") != "team-a" {
+		t.Fatalf("unexpected headers: %v", headers)
+	}
+	if !strings.HasPrefix(headers[0].Get("Authorization"), "Basic ") {
+		t.Fatalf("expected basic auth alongside the tenant: %v", headers[0])
+	}
+}
+
+func TestLokiStats(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	var calls atomic.Int32
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithBatchSize(1),
+		logx.WithBufferSize(1),
+		logx.WithQueueFullPolicy(logx.QueueDropNewest),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+
+	// The first log is stuck in the push, the second one fills the buffer
+	// and the third one is dropped.
+	logger.Info("first")
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	logger.Info("second")
+	logger.Info("third")
+	close(release)
+	stop()
+
+	stats := loki.Stats()
+	if stats.Accepted != 2 || stats.Dropped != 1 || stats.BufferFull != 1 {
+		t.Fatalf("unexpected write stats: %+v", stats)
+	}
+	if stats.BatchesSent != 2 || stats.BatchesFailed != 0 || stats.BytesSent == 0 {
+		t.Fatalf("unexpected send stats: %+v", stats)
+	}
+}
+
+func TestLokiOnError(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	var diagnostics bytes.Buffer
+	var errs []error
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithBackoff(logx.LinearBackoff{Attempts: 1, Step: 0, Jitter: 0}),
+		logx.WithDiagnosticsWriter(&diagnostics),
+		logx.WithOnError(func(err error) {
+			errs = append(errs, err)
+		}),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "failed to send batch") {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if diagnostics.Len() != 0 {
+		t.Fatalf("unexpected diagnostics: %s", diagnostics.String())
+	}
+}
+
+func TestLokiRetries(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, _ := newTestLokiClient(t, srv.Server,
+		logx.WithRetries(3),
+		logx.WithBackoffBounds(10*time.Millisecond, 40*time.Millisecond),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	if err := loki.CloseE(); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+
+	backoff := logx.ExponentialBackoff{Retries: 4, Base: 10 * time.Millisecond, Max: 30 * time.Millisecond, Jitter: 0}
+	var delays []time.Duration
+	for attempt := 0; ; attempt++ {
+		delay, ok := backoff.NextDelay(attempt, nil, nil)
+		if !ok {
+			break
+		}
+		delays = append(delays, delay)
+	}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond}
+	if !slices.Equal(delays, want) {
+		t.Fatalf("unexpected delays: %v", delays)
+	}
+}
+
+func TestLokiWriteContext(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	var calls atomic.Int32
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithBatchSize(1),
+		logx.WithBufferSize(1),
+		logx.WithQueueFullPolicy(logx.QueueBlock),
+	)
+	defer stop()
+	defer close(release)
+
+	record := []byte(`{"time":"2025-01-02T03:04:05.000Z","msg":"hello"}`)
+	// The first record is stuck in the push and the second one fills the
+	// buffer, so the third one blocks until its context is done.
+	if _, err := loki.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := loki.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := loki.WriteContext(ctx, record); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("write did not abort promptly: %s", elapsed)
+	}
+	if stats := loki.Stats(); stats.Dropped != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestLokiDynamicLabels(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithDynamicLabels("level"),
+		logx.WithMaxStreams(2),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("first")
+	logger.Warn("second")
+	logger.Info("third")
+	logger.Error("fourth")
+	stop()
+
+	bodies, _ := srv.requests()
+	if len(bodies) != 2 {
+		t.Fatalf("expected the third stream to start a new batch, got %d requests", len(bodies))
+	}
+	var levels []string
+	for _, stream := range srv.streams(t) {
+		levels = append(levels, fmt.Sprintf("%s:%d", stream.Stream["level"], len(stream.Values)))
+	}
+	if !slices.Equal(levels, []string{"info:2", "warn:1", "error:1"}) {
+		t.Fatalf("unexpected streams: %v", levels)
+	}
+}
+
+func TestLokiStructuredMetadata(t *testing.T) {
+	t.Parallel()
+
+	record := []byte(`{"time":"2025-01-02T03:04:05.000Z","msg":"hello","trace_id":"abc123"}`)
+	for _, enabled := range []bool{true, false} {
+		loki, captured := logx.NewLokiTestClient(logx.WithStructuredMetadata(enabled))
+		if _, err := loki.Write(record); err != nil {
+			t.Fatal(err)
+		}
+		values := captured()
+		if len(values) != 1 {
+			t.Fatalf("expected a single entry, got %v", values)
+		}
+		if !enabled {
+			if len(values[0]) != 2 {
+				t.Fatalf("unexpected metadata without structured metadata: %v", values[0])
+			}
+			continue
+		}
+		metadata, ok := values[0][2].(map[string]any)
+		if len(values[0]) != 3 || !ok || metadata["trace_id"] != "abc123" {
+			t.Fatalf("unexpected entry with structured metadata: %v", values[0])
+		}
+	}
+}
+
+func TestLokiFlush(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithPeriod(time.Hour))
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("first")
+	logger.Info("second")
+
+	if err := loki.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if entries := srv.entries(t); len(entries) != 2 {
+		t.Fatalf("expected the buffered entries to be sent, got %v", entries)
+	}
+
+	stop()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := loki.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error flushing a stopped client: %v", err)
+	}
+}
+
+func TestLokiMaxBatchBytes(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithMaxBatchBytes(1500))
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	for range 5 {
+		logger.Info(strings.Repeat("x", 500))
+	}
+	stop()
+
+	bodies, _ := srv.requests()
+	if len(bodies) != 3 {
+		t.Fatalf("expected batches of 2 entries, got %d requests", len(bodies))
+	}
+	if entries := srv.entries(t); len(entries) != 5 {
+		t.Fatalf("expected every entry to be sent, got %d", len(entries))
+	}
+}
+
+func TestLokiTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	var received atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	loki, _ := newTestLokiClient(t, srv,
+		logx.WithHTTPS(true),
+		logx.WithTLSConfig(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	if err := loki.CloseE(); err != nil {
+		t.Fatal(err)
+	}
+	if received.Load() != 1 {
+		t.Fatalf("expected a push over TLS, got %d", received.Load())
+	}
+}
+
+func TestLokiDiskBuffer(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	down := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	loki, _ := newTestLokiClient(t, down.Server,
+		logx.WithRetries(0),
+		logx.WithDiskBuffer(dir, 1<<20),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("first")
+	logger.Info("second")
+	if err := loki.CloseE(); err == nil {
+		t.Fatal("expected the push to fail")
+	}
+
+	up := newLokiServer(t, nil)
+	loki, _ = newTestLokiClient(t, up.Server, logx.WithDiskBuffer(dir, 1<<20))
+	if err := loki.CloseE(); err != nil {
+		t.Fatal(err)
+	}
+	entries := up.entries(t)
+	if len(entries) != 2 || !strings.Contains(entries[0][1].(string), "first") {
+		t.Fatalf("expected the spilled entries to be replayed, got %v", entries)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected the disk buffer to be emptied, got %v", files)
+	}
+}
+
+func TestLokiFallbackEndpoints(t *testing.T) {
+	t.Parallel()
+
+	primary := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	secondary := newLokiServer(t, nil)
+	u, err := url.Parse(secondary.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loki, _ := newTestLokiClient(t, primary.Server,
+		logx.WithRetries(1),
+		logx.WithBackoffBounds(time.Millisecond, time.Millisecond),
+		logx.WithFallbackEndpoints(u.Host),
+		logx.WithBatchSize(1),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	logger.Info("first")
+	logger.Info("second")
+	if err := loki.CloseE(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bodies, _ := primary.requests(); len(bodies) != 2 {
+		t.Fatalf("expected the retries on the primary only, got %d requests", len(bodies))
+	}
+	if entries := secondary.entries(t); len(entries) != 2 {
+		t.Fatalf("expected the secondary to receive both batches, got %v", entries)
+	}
+}
+
+func TestLokiFallbackEndpointsRetryDuration(t *testing.T) {
+	t.Parallel()
+
+	slow := func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	primary := newLokiServer(t, slow)
+	var fallbacks []string
+	for range 2 {
+		u, err := url.Parse(newLokiServer(t, slow).URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fallbacks = append(fallbacks, u.Host)
+	}
+	loki, stop := newTestLokiClient(t, primary.Server,
+		logx.WithBackoff(logx.ExponentialBackoff{Retries: 10, Base: time.Millisecond, Max: time.Millisecond, Jitter: 0}),
+		logx.WithMaxRetryDuration(250*time.Millisecond),
+		logx.WithFallbackEndpoints(fallbacks...),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Fatalf("failovers exceeded the retry cap: %s", elapsed)
+	}
+}
+
+func TestLokiPathPrefix(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithPathPrefix("/observability/loki/api/v1/"))
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	if paths := srv.requestPaths(); len(paths) != 1 || paths[0] != "POST /observability/loki/api/v1/push" {
+		t.Fatalf("unexpected request paths: %v", paths)
+	}
+}
+
+func TestLokiSortedPayload(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server)
+	for _, i := range rand.Perm(20) {
+		record := fmt.Sprintf(`{"time":"2025-01-02T03:04:%02d.000Z","msg":"%d"}`, i, i)
+		if _, err := loki.Write([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop()
+
+	var last int64
+	for _, value := range srv.entries(t) {
+		ts, err := strconv.ParseInt(value[0].(string), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts < last {
+			t.Fatalf("payload not sorted by time: %d after %d", ts, last)
+		}
+		last = ts
+	}
+}
+
+func TestLokiUserAgent(t *testing.T) {
+	t.Parallel()
+
+	srv := newLokiServer(t, nil)
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithUserAgent("billing/1.2"))
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	_, headers := srv.requests()
+	if len(headers) != 1 || headers[0].Get("User-Agent") != "billing/1.2" {
+		t.Fatalf("unexpected user agent: %v", headers)
+	}
+}
+
+func TestLokiStopContext(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, _ := newTestLokiClient(t, srv.Server, logx.WithDiagnosticsWriter(io.Discard))
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := loki.StopContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stop did not honor its context: %s", elapsed)
+	}
+}
+
+func TestLokiFieldNames(t *testing.T) {
+	t.Parallel()
+
+	loki, captured := logx.NewLokiTestClient(logx.WithTimeField("ts"), logx.WithMessageField("message"))
+	if _, err := loki.Write([]byte(`{"ts":"2025-01-02T03:04:05.000Z","message":"hello","msg":"kept"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loki.Write([]byte(`{"time":"2025-01-02T03:04:05.000Z","msg":"hello"}`)); err == nil {
+		t.Fatal("expected a record without the time field to be rejected")
+	}
+	values := captured()
+
+	if len(values) != 1 || values[0][1] != "hello" {
+		t.Fatalf("unexpected values: %v", values)
+	}
+	if metadata, _ := values[0][2].(map[string]any); metadata["msg"] != "kept" || metadata["ts"] != nil {
+		t.Fatalf("unexpected metadata: %v", values[0][2])
+	}
+}
+
+func TestLokiTimeLayout(t *testing.T) {
+	t.Parallel()
+
+	record := []byte(`{"time":"2025-01-02 03:04:05","msg":"hello"}`)
+	loki, captured := logx.NewLokiTestClient()
+	if _, err := loki.Write(record); err == nil {
+		t.Fatal("expected a non RFC 3339 time to be rejected by default")
+	}
+	captured()
+
+	loki, captured = logx.NewLokiTestClient(logx.WithTimeLayout(time.DateTime))
+	logx.New([]io.Writer{loki}, "Debug", true, true, logx.WithTimeFormat(time.DateTime)).Info("hello")
+	if _, err := loki.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	values := captured()
+	want := strconv.FormatInt(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano(), 10)
+	if len(values) != 2 || (values[0][0] != want && values[1][0] != want) {
+		t.Fatalf("unexpected values: %v", values)
+	}
+}
+
+func TestLokiTimeLayoutArray(t *testing.T) {
+	t.Parallel()
+
+	loki, captured := logx.NewLokiTestClient(logx.WithTimeLayout(time.DateTime), logx.WithJSONArraySplit(true))
+	start := time.Now().Truncate(time.Second)
+	if _, err := loki.Write([]byte(`[{"msg":"a"},{"msg":"b","time":"2025-01-02 03:04:05"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	values := captured()
+	if len(values) != 2 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+	for _, v := range values {
+		ts, _ := strconv.ParseInt(v[0].(string), 10, 64)
+		if v[1] == "a" && time.Unix(0, ts).Before(start) {
+			t.Fatalf("expected the record without a time to get the current one: %v", values)
+		}
+	}
+}
+
+func TestLokiNestedFields(t *testing.T) {
+	t.Parallel()
+
+	loki, captured := logx.NewLokiTestClient()
+	record := `{"time":"2025-01-02T03:04:05.000Z","msg":"hello","user":{"id":1,"roles":["admin"]},"tags":["a","b"]}`
+	if _, err := loki.Write([]byte(record)); err != nil {
+		t.Fatal(err)
+	}
+	values := captured()
+
+	metadata, _ := values[0][2].(map[string]any)
+	for key, want := range map[string]string{"user": `{"id":1,"roles":["admin"]}`, "tags": `["a","b"]`} {
+		got, _ := metadata[key].(string)
+		if !json.Valid([]byte(got)) || got != want {
+			t.Fatalf("expected %s to be encoded as %s, got %q", key, want, got)
+		}
+	}
+}
+
+func TestLokiPing(t *testing.T) {
+	t.Parallel()
+
+	var ready atomic.Bool
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server, logx.WithBearerToken("secret"))
+	defer stop()
+
+	if err := loki.Ping(context.Background()); err == nil {
+		t.Fatal("expected an unready Loki to fail the ping")
+	}
+	ready.Store(true)
+	if err := loki.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	paths := srv.requestPaths()
+	_, headers := srv.requests()
+	if paths[1] != "GET /ready" || headers[1].Get("Authorization") != "Bearer secret" {
+		t.Fatalf("unexpected request %s %v", paths[1], headers[1])
+	}
+}
+
+func TestLokiProxy(t *testing.T) {
+	t.Parallel()
+
+	proxy := newLokiServer(t, nil)
+	loki, stop := logx.NewLokiClient("loki.invalid", 3100, logx.WithProxy(proxy.URL))
+	logx.New([]io.Writer{loki}, "Debug", true, true).Info("This is a test")
+	stop()
+
+	if paths := proxy.requestPaths(); len(paths) != 1 || paths[0] != "POST /loki/api/v1/push" {
+		t.Fatalf("expected the push to go through the proxy, got %v", paths)
+	}
+	if entries := proxy.entries(t); len(entries) != 1 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestLokiCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	var healthy atomic.Bool
+	srv := newLokiServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	loki, stop := newTestLokiClient(t, srv.Server,
+		logx.WithRetries(0),
+		logx.WithBatchSize(1),
+		logx.WithCircuitBreaker(2, 200*time.Millisecond),
+		logx.WithDiagnosticsWriter(io.Discard),
+	)
+	defer stop()
+	logger := logx.New([]io.Writer{loki}, "Debug", true, true)
+	for range 5 {
+		logger.Info("This is a test")
+	}
+	if err := loki.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bodies, _ := srv.requests(); len(bodies) != 2 {
+		t.Fatalf("expected the circuit to open after 2 failures, got %d requests", len(bodies))
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	healthy.Store(true)
+	logger.Info("recovered")
+	logger.Info("again")
+	if err := loki.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bodies, _ := srv.requests(); len(bodies) != 4 {
+		t.Fatalf("expected the circuit to close after recovery, got %d requests", len(bodies))
+	}
+}
@@ -0,0 +1,109 @@
+package logx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const multiSinkBufferSize = 1000
+
+var ErrSinkFull = errors.New("sink buffer is full")
+
+// MultiSink fans each write out to several sinks, each one with its own
+// buffer and goroutine so that a slow or failing sink does not hold the others.
+type MultiSink struct {
+	queues  []chan []byte
+	onError atomic.Pointer[func(sink int, err error)]
+	mu      sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewMultiSink returns a writer copying every write to all the sinks. The
+// writer is a *MultiSink: its Close waits for the sinks to be written, and
+// its OnError receives the sink errors, written to os.Stderr until then.
+func NewMultiSink(sinks ...io.Writer) io.Writer {
+	m := &MultiSink{
+		queues:  make([]chan []byte, len(sinks)),
+		onError: atomic.Pointer[func(sink int, err error)]{},
+		mu:      sync.RWMutex{},
+		closed:  false,
+		wg:      sync.WaitGroup{},
+	}
+
+	for i, sink := range sinks {
+		m.queues[i] = make(chan []byte, multiSinkBufferSize)
+		m.wg.Add(1)
+		go m.run(i, sink)
+	}
+
+	return m
+}
+
+// OnError sets a function called with the index of the sink and the error
+// when a sink fails, including the writes dropped with ErrSinkFull because
+// a sink is lagging.
+func (m *MultiSink) OnError(fn func(sink int, err error)) {
+	if fn == nil {
+		m.onError.Store(nil)
+		return
+	}
+	m.onError.Store(&fn)
+}
+
+func (m *MultiSink) Write(p []byte) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return 0, ErrWriterClosed
+	}
+	entry := append([]byte(nil), p...)
+	for i, queue := range m.queues {
+		select {
+		case queue <- entry:
+		default:
+			m.reportError(i, ErrSinkFull)
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close waits for the buffered writes to be written to the sinks. The later
+// writes fail with ErrWriterClosed.
+func (m *MultiSink) Close() error {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		for _, queue := range m.queues {
+			close(queue)
+		}
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+
+	return nil
+}
+
+func (m *MultiSink) run(i int, sink io.Writer) {
+	defer m.wg.Done()
+
+	for entry := range m.queues[i] {
+		if _, err := sink.Write(entry); err != nil {
+			m.reportError(i, err)
+		}
+	}
+}
+
+func (m *MultiSink) reportError(sink int, err error) {
+	if fn := m.onError.Load(); fn != nil {
+		(*fn)(sink, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[MultiSink] sink %d: %v\n", sink, err)
+}
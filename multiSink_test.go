@@ -0,0 +1,47 @@
+package logx_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/alex-cos/logx"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestMultiSink(t *testing.T) {
+	t.Parallel()
+
+	var first, second bytes.Buffer
+	var failures []string
+	sink := logx.NewMultiSink(&first, failingWriter{}, &second)
+	multi, _ := sink.(*logx.MultiSink)
+	multi.OnError(func(sink int, err error) {
+		failures = append(failures, err.Error())
+		if sink != 1 {
+			t.Errorf("unexpected failing sink %d", sink)
+		}
+	})
+
+	logx.New([]io.Writer{sink}, "Debug", true, true).Info("This is a test")
+	if err := multi.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(first.String(), "This is a test") || !strings.Contains(second.String(), "This is a test") {
+		t.Fatalf("entry not received by healthy sinks: %q, %q", first.String(), second.String())
+	}
+	if len(failures) != 1 || failures[0] != "disk full" {
+		t.Fatalf("unexpected failures: %v", failures)
+	}
+	if _, err := sink.Write([]byte("late")); !errors.Is(err, logx.ErrWriterClosed) {
+		t.Fatalf("expected a write after close to fail, got %v", err)
+	}
+}
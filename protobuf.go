@@ -0,0 +1,109 @@
+package logx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// ProtobufSerializer encodes push requests as the snappy compressed
+// logproto.PushRequest protobuf messages used by Promtail.
+type ProtobufSerializer struct{}
+
+func (ProtobufSerializer) Marshal(streams []LokiStream) ([]byte, string, error) {
+	var req []byte
+	for _, stream := range streams {
+		var msg []byte
+		msg = appendString(msg, 1, labelsString(stream.Stream))
+		for _, value := range stream.Values {
+			entry, err := appendEntry(nil, value)
+			if err != nil {
+				return nil, "", err
+			}
+			msg = appendBytes(msg, 2, entry)
+		}
+		req = appendBytes(req, 1, msg)
+	}
+
+	return snappy.Encode(nil, req), "application/x-protobuf", nil
+}
+
+// appendEntry appends the EntryAdapter message of a value tuple.
+func appendEntry(b []byte, value []any) ([]byte, error) {
+	if len(value) < 2 {
+		return nil, fmt.Errorf("invalid value %v", value)
+	}
+	tsStr, _ := value[0].(string)
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var timestamp []byte
+	timestamp = appendVarint(timestamp, 1, uint64(ts/1e9)) // nolint: gosec
+	timestamp = appendVarint(timestamp, 2, uint64(ts%1e9)) // nolint: gosec
+	b = appendBytes(b, 1, timestamp)
+	b = appendString(b, 2, fmt.Sprint(value[1]))
+	if len(value) > 2 {
+		metadata, _ := value[2].(map[string]any)
+		keys := make([]string, 0, len(metadata))
+		for k := range metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var pair []byte
+			pair = appendString(pair, 1, k)
+			pair = appendString(pair, 2, fmt.Sprint(metadata[k]))
+			b = appendBytes(b, 3, pair)
+		}
+	}
+
+	return b, nil
+}
+
+// labelsString formats labels the Prometheus way, {a="1", b="2"}.
+func labelsString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+	}
+	sb.WriteByte('}')
+
+	return sb.String()
+}
+
+func appendVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+
+	return append(b, v...)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+
+	return append(b, v...)
+}
@@ -0,0 +1,62 @@
+package logx
+
+import (
+	"log/slog"
+	"strings"
+)
+
+const redacted = "***"
+
+// WithRedactKeys replaces the values of the attributes with one of the keys
+// by "***", whatever their case. A key matches the attribute key, in any
+// group, or its path of dot separated groups, e.g. "request.token". The
+// builtin time, level, source and message attributes are never redacted.
+func WithRedactKeys(keys ...string) LoggerOption {
+	return func(c *loggerConfig) {
+		c.redactKeys = append(c.redactKeys, keys...)
+	}
+}
+
+// redactAttr wraps a ReplaceAttr function to redact the attributes with one
+// of keys first.
+func redactAttr(
+	keys []string,
+	next func(groups []string, a slog.Attr) slog.Attr,
+) func(groups []string, a slog.Attr) slog.Attr {
+	set := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		set[strings.ToLower(k)] = struct{}{}
+	}
+
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && isBuiltinKey(a.Key) {
+			if next != nil {
+				return next(groups, a)
+			}
+
+			return a
+		}
+		key := strings.ToLower(a.Key)
+		_, match := set[key]
+		if !match && len(groups) > 0 {
+			_, match = set[strings.ToLower(strings.Join(groups, "."))+"."+key]
+		}
+		if match {
+			a.Value = slog.StringValue(redacted)
+		}
+		if next != nil {
+			return next(groups, a)
+		}
+
+		return a
+	}
+}
+
+func isBuiltinKey(key string) bool {
+	switch key {
+	case slog.TimeKey, slog.LevelKey, slog.SourceKey, slog.MessageKey:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,55 @@
+package logx
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// WithSampling keeps only 1 of every n records of each level below warn,
+// see NewSampled.
+func WithSampling(n int) LoggerOption {
+	return func(c *loggerConfig) {
+		c.sampling = n
+	}
+}
+
+// NewSampled wraps a handler to pass only the first of every n records of
+// each level below warn, the warn and error records all being passed. The
+// handlers derived with WithAttrs and WithGroup share the counts.
+func NewSampled(inner slog.Handler, n int) slog.Handler {
+	if n <= 1 {
+		return inner
+	}
+
+	return sampleHandler{inner, uint64(n), &sync.Map{}}
+}
+
+type sampleHandler struct {
+	slog.Handler
+	n      uint64
+	counts *sync.Map // slog.Level to *atomic.Uint64
+}
+
+func (h sampleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		count, ok := h.counts.Load(r.Level)
+		if !ok {
+			count, _ = h.counts.LoadOrStore(r.Level, &atomic.Uint64{})
+		}
+		if (count.(*atomic.Uint64).Add(1)-1)%h.n != 0 { // nolint: forcetypeassert
+			return nil
+		}
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return sampleHandler{h.Handler.WithAttrs(attrs), h.n, h.counts}
+}
+
+func (h sampleHandler) WithGroup(name string) slog.Handler {
+	return sampleHandler{h.Handler.WithGroup(name), h.n, h.counts}
+}
@@ -0,0 +1,35 @@
+package logx
+
+import "encoding/json"
+
+// LokiStream is a set of entries sharing the same labels. Each value is a
+// [timestamp, line] or [timestamp, line, metadata] tuple, the timestamp being
+// the nanoseconds since epoch formatted as a string.
+type LokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]any           `json:"values"`
+}
+
+// Serializer encodes the streams of a push request. Marshal returns the
+// request body and its content type.
+type Serializer interface {
+	Marshal(streams []LokiStream) ([]byte, string, error)
+}
+
+type lokiRequest struct {
+	Streams []LokiStream `json:"streams"`
+}
+
+// JSONSerializer encodes push requests for the Loki JSON API.
+type JSONSerializer struct{}
+
+func (JSONSerializer) Marshal(streams []LokiStream) ([]byte, string, error) {
+	buf, err := json.Marshal(&lokiRequest{
+		Streams: streams,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf, "application/json", nil
+}
@@ -0,0 +1,68 @@
+package logx
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+)
+
+// levelSteps are the levels WatchSignals moves between.
+var levelSteps = []slog.Level{LevelTrace, slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError, LevelFatal}
+
+// WatchSignals moves the level of d up to the next one, e.g. from debug to
+// info, on the up signal, and down to the previous one, e.g. from info to
+// debug, on the down signal, between trace and fatal. It returns a function
+// stopping the watch.
+//
+// SIGUSR1 and SIGUSR2, the usual choices, are not available on Windows,
+// where only os.Interrupt can be relied on.
+func WatchSignals(d *DynamicLevel, up, down os.Signal) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, up, down)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				switch sig {
+				case up:
+					d.SetLevel(stepLevel(d.Level(), true))
+				case down:
+					d.SetLevel(stepLevel(d.Level(), false))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+}
+
+// stepLevel returns the first level of levelSteps above l, or below it when
+// up is false, staying at the ends.
+func stepLevel(l slog.Level, up bool) slog.Level {
+	if up {
+		for _, step := range levelSteps {
+			if step > l {
+				return step
+			}
+		}
+		return levelSteps[len(levelSteps)-1]
+	}
+	for _, step := range slices.Backward(levelSteps) {
+		if step < l {
+			return step
+		}
+	}
+
+	return levelSteps[0]
+}
@@ -0,0 +1,45 @@
+//go:build unix
+
+package logx_test
+
+import (
+	"log/slog"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alex-cos/logx"
+)
+
+func TestWatchSignals(t *testing.T) {
+	t.Parallel()
+
+	level := logx.NewDynamicLevel(slog.LevelInfo)
+	changes := make(chan slog.Level, 4)
+	level.OnChange(func(_, newLevel slog.Level) {
+		changes <- newLevel
+	})
+	stop := logx.WatchSignals(level, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer stop()
+
+	for _, tc := range []struct {
+		sig  syscall.Signal
+		want slog.Level
+	}{
+		{syscall.SIGUSR2, slog.LevelDebug},
+		{syscall.SIGUSR2, logx.LevelTrace},
+		{syscall.SIGUSR1, slog.LevelDebug},
+	} {
+		if err := syscall.Kill(syscall.Getpid(), tc.sig); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-changes:
+			if got != tc.want {
+				t.Fatalf("unexpected level %s after %s, want %s", got, tc.sig, tc.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no level change after %s", tc.sig)
+		}
+	}
+}
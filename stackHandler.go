@@ -0,0 +1,134 @@
+package logx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// WithStackTrace adds a stacktrace attribute to the records of minLevel and
+// above. It is the stack of the first error attribute when the error has
+// one, like the pkg/errors ones, and the stack of the logging call otherwise.
+func WithStackTrace(minLevel slog.Level) LoggerOption {
+	return func(c *loggerConfig) {
+		c.stackTrace = true
+		c.stackLevel = minLevel
+	}
+}
+
+// NewStackTraceHandler wraps a handler to add a stacktrace attribute to the
+// records of minLevel and above, as set by WithStackTrace.
+func NewStackTraceHandler(h slog.Handler, minLevel slog.Level) slog.Handler {
+	return stackHandler{h, minLevel}
+}
+
+type stackHandler struct {
+	slog.Handler
+	minLevel slog.Level
+}
+
+func (h stackHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.minLevel {
+		frames := stackFrames(recordErrorStack(r))
+		if frames == nil {
+			frames = callerFrames()
+		}
+		r = r.Clone()
+		r.AddAttrs(slog.String(SStackTrace, formatFrames(frames)))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h stackHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return stackHandler{h.Handler.WithAttrs(attrs), h.minLevel}
+}
+
+func (h stackHandler) WithGroup(name string) slog.Handler {
+	return stackHandler{h.Handler.WithGroup(name), h.minLevel}
+}
+
+// recordErrorStack returns the stack of the first error attribute of the
+// record having one, if any.
+func recordErrorStack(r slog.Record) []uintptr {
+	var pcs []uintptr
+	r.Attrs(func(a slog.Attr) bool {
+		if err, ok := a.Value.Any().(error); ok {
+			pcs = errorStack(err)
+		}
+		return pcs == nil
+	})
+
+	return pcs
+}
+
+// errorStack returns the stack of the innermost error of the chain with a
+// StackTrace method returning program counters, like the pkg/errors ones.
+func errorStack(err error) []uintptr {
+	var pcs []uintptr
+	for ; err != nil; err = errors.Unwrap(err) {
+		method := reflect.ValueOf(err).MethodByName("StackTrace")
+		if !method.IsValid() {
+			continue
+		}
+		typ := method.Type()
+		if typ.NumIn() != 0 || typ.NumOut() != 1 ||
+			typ.Out(0).Kind() != reflect.Slice || typ.Out(0).Elem().Kind() != reflect.Uintptr {
+			continue
+		}
+		frames := method.Call(nil)[0]
+		pcs = make([]uintptr, frames.Len())
+		for i := range pcs {
+			pcs[i] = uintptr(frames.Index(i).Uint())
+		}
+	}
+
+	return pcs
+}
+
+// callerFrames returns the stack of the logging call, without the leading
+// slog and logx frames.
+func callerFrames() []runtime.Frame {
+	pcs := make([]uintptr, 64)
+	frames := stackFrames(pcs[:runtime.Callers(2, pcs)])
+	for i, frame := range frames {
+		if !strings.HasPrefix(frame.Function, "log/slog.") &&
+			!strings.HasPrefix(frame.Function, "github.com/alex-cos/logx.") {
+			return frames[i:]
+		}
+	}
+
+	return nil
+}
+
+func stackFrames(pcs []uintptr) []runtime.Frame {
+	if len(pcs) == 0 {
+		return nil
+	}
+	var frames []runtime.Frame
+	iter := runtime.CallersFrames(pcs)
+	for {
+		frame, more := iter.Next()
+		if frame.Function != "" {
+			frames = append(frames, frame)
+		}
+		if !more {
+			return frames
+		}
+	}
+}
+
+// formatFrames renders a stack with a function line and an indented
+// file:line per frame, like panics do.
+func formatFrames(frames []runtime.Frame) string {
+	var sb strings.Builder
+	for _, frame := range frames {
+		fmt.Fprintf(&sb, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+	}
+
+	return sb.String()
+}
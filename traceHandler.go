@@ -0,0 +1,46 @@
+package logx
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTraceContext adds the trace_id and span_id of the OpenTelemetry span of
+// the record context, if any, to the records.
+func WithTraceContext(b bool) LoggerOption {
+	return func(c *loggerConfig) {
+		c.traceContext = b
+	}
+}
+
+// NewTraceHandler wraps a handler to add the trace_id and span_id of the
+// OpenTelemetry span of the record context, if any, to the records.
+func NewTraceHandler(h slog.Handler) slog.Handler {
+	return traceHandler{h}
+}
+
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r = r.Clone()
+		r.AddAttrs(
+			slog.String(STraceID, sc.TraceID().String()),
+			slog.String(SSpanID, sc.SpanID().String()),
+		)
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}